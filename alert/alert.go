@@ -0,0 +1,52 @@
+// Package alert logs events that need attention and forwards them to a webhook if one is configured
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/thefeli73/polemos/state"
+)
+
+// Event is the json body posted to the webhook
+type Event struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Send logs an alert and posts it to the configured webhook
+func Send(config state.Config, kind string, message string) {
+	e := Event{kind, message, time.Now().UTC()}
+	fmt.Printf("ALERT (%s):\t%s\n", kind, message)
+	if config.MTD.AlertWebhook == "" {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Println("Error encoding alert:\t", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.MTD.AlertWebhook, bytes.NewReader(data))
+	if err != nil {
+		fmt.Println("Error sending alert:\t", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("Error sending alert:\t", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		fmt.Printf("Error sending alert: webhook returned %d\n", res.StatusCode)
+	}
+}
@@ -0,0 +1,130 @@
+// Package bootstrap installs and configures Proxima Centauri on the instances Polemos launches for proxies
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pki"
+	"github.com/thefeli73/polemos/state"
+	"gopkg.in/yaml.v3"
+)
+
+// Dir is where the proxy configuration is written on the instance
+const Dir = "/etc/proxima-centauri"
+
+// DefaultExec is the command running the proxy when none is configured
+const DefaultExec = "/usr/local/bin/proxima-centauri --config " + Dir + "/bundle.yaml"
+
+// DefaultTimeout is how long a new proxy may take to answer when none is configured
+const DefaultTimeout = 5 * time.Minute
+
+// ErrNoEntry is returned when a proxy with certificates is bootstrapped without knowing the address it will answer on
+var ErrNoEntry = errors.New("certificate needs the entry ip of the proxy")
+
+const unit = `[Unit]
+Description=Proxima Centauri
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+`
+
+type cloudConfig struct {
+	WriteFiles []cloudFile `yaml:"write_files"`
+	RunCmd     []string    `yaml:"runcmd"`
+}
+
+type cloudFile struct {
+	Path        string `yaml:"path"`
+	Permissions string `yaml:"permissions"`
+	Content     string `yaml:"content"`
+}
+
+// Enabled returns if fresh proxy instances are bootstrapped in region
+func Enabled(config state.Config, region string) bool {
+	return config.MTD.Bootstrap.Images[region] != ""
+}
+
+// Prepare returns the bundle of the proxy on entry, with its certificates if the pki is enabled
+func Prepare(config state.Config, entry netip.Addr) (pki.Bundle, error) {
+	if config.MTD.PKI.Dir == "" {
+		return pki.Bundle{
+			EntryIP:        entry,
+			ManagementPort: config.ManagementAddr(entry).Port(),
+			SigningKey:     config.SigningKey(entry),
+			SignatureSkew:  config.MTD.SignatureSkew,
+		}, nil
+	}
+	if !entry.IsValid() {
+		return pki.Bundle{}, ErrNoEntry
+	}
+	return pki.Enroll(config, entry)
+}
+
+// UserData returns the cloud-init user data that installs Proxima Centauri, configures it with bundle and starts it.
+// The bundle, including the signing key and the TLS key of the proxy, is written to a single file only readable by
+// root. User data itself is not secret though: every process on the instance can read it from the instance metadata
+// service, and so can every AWS principal allowed to describe the instance attributes
+func UserData(config state.Config, bundle pki.Bundle) (string, error) {
+	exec := config.MTD.Bootstrap.Exec
+	if exec == "" {
+		exec = DefaultExec
+	}
+	data, err := yaml.Marshal(bundle)
+	if err != nil {
+		return "", err
+	}
+
+	var c cloudConfig
+	c.WriteFiles = append(c.WriteFiles, cloudFile{Path: Dir + "/bundle.yaml", Permissions: "0600", Content: string(data)})
+	c.WriteFiles = append(c.WriteFiles, cloudFile{Path: "/etc/systemd/system/proxima-centauri.service",
+		Permissions: "0644", Content: fmt.Sprintf(unit, exec)})
+	if config.MTD.Bootstrap.Install != "" {
+		c.RunCmd = append(c.RunCmd, config.MTD.Bootstrap.Install)
+	}
+	c.RunCmd = append(c.RunCmd, "systemctl daemon-reload", "systemctl enable --now proxima-centauri")
+
+	data, err = yaml.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return "#cloud-config\n" + string(data), nil
+}
+
+// Timeout returns how long to wait for a bootstrapped proxy to answer
+func Timeout(config state.Config) time.Duration {
+	if config.MTD.Bootstrap.Timeout > 0 {
+		return time.Duration(config.MTD.Bootstrap.Timeout) * time.Second
+	}
+	return DefaultTimeout
+}
+
+// Wait polls the status of a proxy until it answers or timeout passes
+func Wait(ctx context.Context, proxy pcsdk.Proxy, timeout time.Duration, poll time.Duration) error {
+	if poll <= 0 {
+		poll = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		_, err := proxy.Status(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("proxy %s did not come up: %w", proxy.Addr().Addr(), err)
+		case <-time.After(poll):
+		}
+	}
+}
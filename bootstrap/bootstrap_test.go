@@ -0,0 +1,142 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/pki"
+	"github.com/thefeli73/polemos/state"
+	"gopkg.in/yaml.v3"
+)
+
+func testConfig(t *testing.T) state.Config {
+	var config state.Config
+	config.MTD.PKI.Dir = t.TempDir()
+	config.MTD.ManagementPort = 14000
+	config.MTD.SigningKey = "secret"
+	return config
+}
+
+func TestUserData(t *testing.T) {
+	config := testConfig(t)
+	config.MTD.Bootstrap.Install = "curl -fsSL https://example.com/install.sh | sh"
+	config, err := pki.Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	bundle, err := Prepare(config, netip.MustParseAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	data, err := UserData(config, bundle)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if !strings.HasPrefix(data, "#cloud-config\n") {
+		t.Fatalf("expected cloud-config, got %q", data)
+	}
+
+	var c cloudConfig
+	err = yaml.Unmarshal([]byte(data), &c)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	files := make(map[string]string)
+	for _, f := range c.WriteFiles {
+		files[f.Path] = f.Content
+	}
+	var written pki.Bundle
+	err = yaml.Unmarshal([]byte(files[Dir+"/bundle.yaml"]), &written)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if written.ManagementPort != 14000 || written.SigningKey != "secret" || written.Cert != bundle.Cert {
+		t.Fatalf("unexpected bundle %+v", written)
+	}
+	// the key is only written once, in the bundle
+	line := strings.Split(bundle.Key, "\n")[1]
+	if len(c.WriteFiles) != 2 || strings.Count(data, line) != 1 {
+		t.Fatalf("expected the key to be written once, got %q", data)
+	}
+	if !strings.Contains(files["/etc/systemd/system/proxima-centauri.service"], "ExecStart="+DefaultExec) {
+		t.Fatalf("expected default exec in unit, got %q", files["/etc/systemd/system/proxima-centauri.service"])
+	}
+	if len(c.RunCmd) != 3 || c.RunCmd[0] != config.MTD.Bootstrap.Install {
+		t.Fatalf("unexpected runcmd %q", c.RunCmd)
+	}
+}
+
+func TestPrepareWithoutPKI(t *testing.T) {
+	config := testConfig(t)
+	config.MTD.PKI.Dir = ""
+	bundle, err := Prepare(config, netip.Addr{})
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if bundle.Cert != "" || bundle.SigningKey != "secret" {
+		t.Fatalf("unexpected bundle %+v", bundle)
+	}
+
+	config.MTD.PKI.Dir = t.TempDir()
+	_, err = Prepare(config, netip.Addr{})
+	if err != ErrNoEntry {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", ErrNoEntry, err)
+	}
+}
+
+func TestWaitVerifiesCertificateOfEntry(t *testing.T) {
+	config := testConfig(t)
+	config, err := pki.Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	// the bootstrapped proxy answers on another address than the entry its certificate is for
+	entry := netip.MustParseAddr("192.0.2.1")
+	bundle, err := Prepare(config, entry)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	cert, err := tls.X509KeyPair([]byte(bundle.Cert), []byte(bundle.Key))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(bundle.CA))
+	s := pcsdktest.NewTLSServer(bundle.SigningKey, 0, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer s.Close()
+	client, err := pcsdk.ClientTLSConfig(config.MTD.TLS.CAPath, config.MTD.TLS.CertPath, config.MTD.TLS.KeyPath, "")
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	proxy := s.Proxy().WithTLS(client).WithTimeout(100 * time.Millisecond)
+	err = Wait(context.Background(), proxy, 200*time.Millisecond, 10*time.Millisecond)
+	if err == nil {
+		t.Fatalf("expected certificate of another address to be rejected")
+	}
+	err = Wait(context.Background(), proxy.WithServerName(entry.String()), time.Second, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+}
+
+func TestWaitForProxyDown(t *testing.T) {
+	s := pcsdktest.NewServer()
+	proxy := s.Proxy().WithTimeout(50 * time.Millisecond)
+	s.Close()
+	err := Wait(context.Background(), proxy, 200*time.Millisecond, 10*time.Millisecond)
+	if err == nil {
+		t.Fatalf("expected error waiting for a proxy that is down")
+	}
+}
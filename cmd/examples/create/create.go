@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
 
@@ -14,7 +15,7 @@ func main() {
 	ip := netip.MustParseAddr("127.0.0.1")
 	uuid := uuid.MustParse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
 
-	err := proxy.Create(5555, 8080, ip, state.CustomUUID(uuid))
+	err := proxy.Create(context.Background(), 5555, 8080, ip, state.CustomUUID(uuid))
 	if err != nil {
 		fmt.Printf("error executing create command: %s\n", err)
 	} else {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
 
@@ -13,7 +14,7 @@ func main() {
 	proxy := pcsdk.BuildProxy(netip.MustParseAddrPort("127.0.0.1:14000"))
 	uuid := uuid.MustParse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
 
-	err := proxy.Delete(state.CustomUUID(uuid))
+	err := proxy.Delete(context.Background(), state.CustomUUID(uuid))
 	if err != nil {
 		fmt.Printf("error executing delete command: %s\n", err)
 	} else {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
 
@@ -14,7 +15,7 @@ func main() {
 	ip := netip.MustParseAddr("127.0.0.1")
 	uuid := uuid.MustParse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
 
-	err := proxy.Modify(9111, ip, state.CustomUUID(uuid))
+	err := proxy.Modify(context.Background(), 9111, ip, state.CustomUUID(uuid))
 	if err != nil {
 		fmt.Printf("error executing modify command: %s\n", err)
 	} else {
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+)
+
+func main() {
+	proxy := pcsdk.BuildProxy(netip.MustParseAddrPort("127.0.0.1:14000"))
+
+	status, err := proxy.Status(context.Background())
+	if err != nil {
+		fmt.Printf("error executing status command: %s\n", err)
+		return
+	}
+	fmt.Printf("proxy version %s, up %s\n", status.Version, status.UptimeDuration())
+	for id, tunnel := range status.Tunnels {
+		fmt.Printf("%s\t:%d -> %s:%d\t%s\n", uuid.UUID(id).String(), tunnel.IncomingPort, tunnel.DestinationIP, tunnel.DestinationPort, tunnel.Usage())
+	}
+}
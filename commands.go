@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+
+	"github.com/thefeli73/polemos/bootstrap"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pki"
+	"github.com/thefeli73/polemos/reconcile"
+	"github.com/thefeli73/polemos/state"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage: polemos [command]
+
+Without a command Polemos starts doing MTD.
+
+Commands:
+    enroll <entry_ip> [file]    print (or write to file) the enrollment bundle for a new proxy
+    userdata <entry_ip> [file]  print (or write to file) cloud-init user data installing a new proxy
+    diff                        print how the tunnels on the proxies differ from the config
+`
+
+// runCommand runs a CLI subcommand and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "enroll":
+		return enroll(args[1:])
+	case "userdata":
+		return userdata(args[1:])
+	case "diff":
+		return diff()
+	default:
+		fmt.Print(usage)
+		return 2
+	}
+}
+
+// enroll issues the certificate of the proxy on an entry ip and outputs everything it needs as yaml
+func enroll(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Print(usage)
+		return 2
+	}
+	entry, err := netip.ParseAddr(args[0])
+	if err != nil {
+		fmt.Println("Error parsing entry ip:\t", err)
+		return 1
+	}
+
+	config := state.LoadConf(ConfigPath)
+	bundle, err := pki.Enroll(config, entry)
+	if err != nil {
+		fmt.Println("Error enrolling proxy:\t", err)
+		return 1
+	}
+	data, err := yaml.Marshal(bundle)
+	if err != nil {
+		fmt.Println("Error encoding bundle:\t", err)
+		return 1
+	}
+
+	if len(args) == 2 {
+		err = ioutil.WriteFile(args[1], data, 0600)
+		if err != nil {
+			fmt.Println("Error writing bundle:\t", err)
+			return 1
+		}
+		fmt.Println("Wrote enrollment bundle:\t", args[1])
+		return 0
+	}
+	fmt.Print(string(data))
+	return 0
+}
+
+// userdata outputs the cloud-init user data that installs and configures the proxy on an entry ip
+func userdata(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Print(usage)
+		return 2
+	}
+	entry, err := netip.ParseAddr(args[0])
+	if err != nil {
+		fmt.Println("Error parsing entry ip:\t", err)
+		return 1
+	}
+
+	config := state.LoadConf(ConfigPath)
+	bundle, err := bootstrap.Prepare(config, entry)
+	if err != nil {
+		fmt.Println("Error enrolling proxy:\t", err)
+		return 1
+	}
+	data, err := bootstrap.UserData(config, bundle)
+	if err != nil {
+		fmt.Println("Error generating user data:\t", err)
+		return 1
+	}
+
+	if len(args) == 2 {
+		err = ioutil.WriteFile(args[1], []byte(data), 0600)
+		if err != nil {
+			fmt.Println("Error writing user data:\t", err)
+			return 1
+		}
+		fmt.Println("Wrote user data:\t", args[1])
+		return 0
+	}
+	fmt.Print(data)
+	return 0
+}
+
+// diff prints the drift between the config and the proxies without changing anything
+func diff() int {
+	config := state.LoadConf(ConfigPath)
+	report := reconcile.Run(config, pcsdk.NewFleet(config), true)
+	if report.Unreachable > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+// Package failover keeps services reachable when one of their redundant entry proxies fails
+package failover
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/alert"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+// Run takes entry proxies that failed too many status checks in a row out of rotation and puts recovered ones back.
+// If the primary entry of a service is out of rotation, a redundant entry in rotation takes its place.
+// Services with a single entry proxy are left alone, there is nothing to fail over to
+func Run(config state.Config, fleet *pcsdk.ProxyFleet) state.Config {
+	after := config.MTD.FailoverAfter
+	if after <= 0 {
+		after = 1
+	}
+	for id, service := range config.MTD.Services {
+		entries := service.Entries()
+		if len(entries) < 2 {
+			continue
+		}
+		var out []netip.Addr
+		for _, entry := range entries {
+			if fp, ok := fleet.Get(entry); ok && fp.Failures >= after {
+				out = append(out, entry)
+			}
+		}
+		if len(out) == len(entries) {
+			// keep the current rotation, no entry is any better than another
+			continue
+		}
+		next := service
+		next.OutOfRotation = out
+		for _, entry := range entries {
+			if service.InRotation(entry) && !next.InRotation(entry) {
+				fmt.Printf("Dropped proxy %s from rotation of service %s\n", entry, uuid.UUID(id))
+			} else if !service.InRotation(entry) && next.InRotation(entry) {
+				fmt.Printf("Proxy %s back in rotation of service %s\n", entry, uuid.UUID(id))
+			}
+		}
+		service = next
+
+		if !service.InRotation(service.EntryIP) {
+			previous := service.EntryIP
+			rotation := service.Rotation()
+			service.EntryIP = rotation[0]
+			var redundant []netip.Addr
+			for _, entry := range entries {
+				if entry != service.EntryIP {
+					redundant = append(redundant, entry)
+				}
+			}
+			service.EntryIPs = redundant
+			alert.Send(config, "entry_failover", fmt.Sprintf("service %s failed over from proxy %s to %s",
+				uuid.UUID(id), previous, service.EntryIP))
+		}
+		config.MTD.Services[id] = service
+	}
+	return config
+}
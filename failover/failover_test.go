@@ -0,0 +1,52 @@
+package failover
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/state"
+)
+
+func TestFailover(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	live := s.Addr().Addr()
+	down := netip.MustParseAddr("127.0.0.2")
+	var config state.Config
+	config.MTD.ManagementPort = s.Addr().Port()
+	config.MTD.FailoverAfter = 1
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	redundant := state.CustomUUID(uuid.New())
+	single := state.CustomUUID(uuid.New())
+	config.MTD.Services[redundant] = state.Service{AdminEnabled: true, Active: true, EntryIP: down, EntryIPs: []netip.Addr{live}}
+	config.MTD.Services[single] = state.Service{AdminEnabled: true, Active: true, EntryIP: down}
+	fleet := pcsdk.NewFleet(config)
+	fleet.Refresh(context.Background())
+
+	config = Run(config, fleet)
+	service := config.MTD.Services[redundant]
+	if service.EntryIP != live || len(service.EntryIPs) != 1 || service.EntryIPs[0] != down {
+		t.Fatalf("expected failover to %s, got %+v", live, service)
+	}
+	if service.InRotation(down) || len(service.Rotation()) != 1 {
+		t.Fatalf("expected %s out of rotation, got %+v", down, service)
+	}
+	if len(service.Entries()) != 2 {
+		t.Fatalf("expected %s to keep both entries, got %+v", redundant, service.Entries())
+	}
+	if config.MTD.Services[single].EntryIP != down || len(config.MTD.Services[single].OutOfRotation) != 0 {
+		t.Fatalf("expected single entry service to be left alone, got %+v", config.MTD.Services[single])
+	}
+
+	// with every entry down there is nothing to fail over to
+	s.Close()
+	fleet.Refresh(context.Background())
+	config = Run(config, fleet)
+	if config.MTD.Services[redundant].EntryIP != live {
+		t.Fatalf("expected rotation to be kept, got %+v", config.MTD.Services[redundant])
+	}
+}
@@ -1,61 +1,132 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/netip"
+	"os"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/alert"
+	"github.com/thefeli73/polemos/failover"
 	"github.com/thefeli73/polemos/mtdaws"
 	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pki"
+	"github.com/thefeli73/polemos/porthop"
+	"github.com/thefeli73/polemos/publish"
+	"github.com/thefeli73/polemos/reconcile"
 	"github.com/thefeli73/polemos/state"
+	"github.com/thefeli73/polemos/stats"
 )
 
 // ConfigPath is a string of the location for the configfile
 var ConfigPath string
 
 func main() {
-	fmt.Println("Starting Polemos")
-
 	ConfigPath = "config.yaml"
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	fmt.Println("Starting Polemos")
 	
     // Initialize the config.Services map
 	var config state.Config
 	config.MTD.Services = make(map[state.CustomUUID]state.Service)
 
 	config = state.LoadConf(ConfigPath)
+	config = state.IndexProxies(config)
 	state.SaveConf(ConfigPath, config)
 
+	config = rotateCertificates(config)
 
 	config = indexAllInstances(config)
 	state.SaveConf(ConfigPath, config)
 
+	// ACCEPT PROXIES PULLING THEIR COMMANDS
+	err := pcsdk.StartHub(config)
+	if err != nil {
+		fmt.Println("Error starting hub:\t", err)
+	}
+
+	// CHECK PROXIES
+	fleet := pcsdk.NewFleet(config)
+	checkFleet(config, fleet)
+
 	// CREATE TUNNELS
-	createTunnels(config)
+	createTunnels(config, fleet)
+
+	// PUBLISH ENTRY PORTS
+	publisher, err := publish.Start(config)
+	if err != nil {
+		fmt.Println("Error starting publisher:\t", err)
+	}
+
+	// COLLECT TRAFFIC STATS
+	collector, err := stats.Start(config)
+	if err != nil {
+		fmt.Println("Error loading stats:\t", err)
+	}
 
 	// START DOING MTD
-	mtdLoop(config)
+	mtdLoop(config, fleet, publisher, collector)
 }
 
-func mtdLoop(config state.Config) {
+func mtdLoop(config state.Config, fleet *pcsdk.ProxyFleet, publisher *publish.Server, collector *stats.Collector) {
 	for true {
+		config = rotateCertificates(config)
+		pki.RenewProxies(context.TODO(), config, fleet)
+
 		//TODO: figure out migration (MTD)
-		config = movingTargetDefense(config)
+		config = movingTargetDefense(config, fleet)
+		state.SaveConf(ConfigPath, config)
+
+		config = mtdaws.AWSMoveProxies(config, fleet)
 		state.SaveConf(ConfigPath, config)
 
+		config = porthop.Run(config)
+		state.SaveConf(ConfigPath, config)
+
+		// only proxies configured to pull are accepted by the hub
+		pcsdk.DefaultHub.Update(config)
+
+		fleet.Update(config)
+		checkFleet(config, fleet)
+		config = failover.Run(config, fleet)
+		state.SaveConf(ConfigPath, config)
+
+		// converge proxies to the services map, then drop instances no proxy forwards to anymore
+		reconcile.Run(config, fleet, config.MTD.ReconcileDryRun)
+		config = mtdaws.AWSCleanupRetired(config, fleet)
+		state.SaveConf(ConfigPath, config)
+		publisher.Update(config)
+		collector.Run(config, fleet)
+
 		fmt.Println("Sleeping for 1 minute")
-		time.Sleep(1*time.Minute)
+		// keep watching for proxy restarts while sleeping
+		watchFleet(config, fleet, time.Duration(config.MTD.RestartPoll)*time.Second, 1*time.Minute)
 
 		//TODO: proxy commands
 	}
 }
 
-func movingTargetDefense(config state.Config) state.Config{
-
-	mtdaws.AWSMoveInstance(config)
+func rotateCertificates(config state.Config) state.Config {
+	config, err := pki.Rotate(config)
+	if err != nil {
+		fmt.Println("Error rotating certificates:\t", err)
+		return config
+	}
+	state.SaveConf(ConfigPath, config)
 	return config
 }
 
+func movingTargetDefense(config state.Config, fleet *pcsdk.ProxyFleet) state.Config{
+
+	return mtdaws.AWSMoveInstance(config, fleet)
+}
+
 func indexAllInstances(config state.Config) state.Config {
 	fmt.Println("Indexing instances")
 	t := time.Now()
@@ -93,17 +164,66 @@ func indexAllInstances(config state.Config) state.Config {
 	return config
 }
 
-func createTunnels(config state.Config) {
+// checkFleet checks the status of every proxy, alerting on those that went down, came back or restarted, and gives
+// restarted proxies their tunnels back right away
+func checkFleet(config state.Config, fleet *pcsdk.ProxyFleet) {
+	t := time.Now()
+	for _, changed := range fleet.Refresh(context.Background()) {
+		if changed.Healthy {
+			alert.Send(config, "proxy_up", fmt.Sprintf("proxy %s is reachable again", changed.Addr))
+		} else {
+			alert.Send(config, "proxy_down", fmt.Sprintf("proxy %s is unreachable: %s", changed.Addr, changed.LastError))
+		}
+	}
+	restarted := fleet.Restarted()
+	for _, entry := range restarted {
+		alert.Send(config, "proxy_restart", fmt.Sprintf("proxy %s restarted and lost its tunnels", entry))
+	}
+	fmt.Printf("%d/%d proxies healthy, %d restarted (took %s)\n", len(fleet.Healthy()), len(fleet.Proxies()), len(restarted), time.Since(t).Round(100*time.Millisecond).String())
+	reconcile.RunReplay(config, fleet, restarted, config.MTD.ReconcileDryRun)
+}
+
+// watchFleet checks the fleet every interval until d has passed, so restarted proxies are not left without tunnels
+// until the next round
+func watchFleet(config state.Config, fleet *pcsdk.ProxyFleet, interval time.Duration, d time.Duration) {
+	deadline := time.Now().Add(d)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return
+		}
+		if interval > 0 && interval < wait {
+			wait = interval
+		}
+		time.Sleep(wait)
+		if interval <= 0 {
+			continue
+		}
+		checkFleet(config, fleet)
+	}
+}
+
+func createTunnels(config state.Config, fleet *pcsdk.ProxyFleet) {
+	ctx := context.Background()
 	for serviceUUID, service := range config.MTD.Services {
-		if service.AdminEnabled && service.Active {
-			proxy := pcsdk.BuildProxy(netip.AddrPortFrom(service.EntryIP, config.MTD.ManagementPort))
-			err := proxy.Status()
-			if err != nil {
+		if !service.AdminEnabled || !service.Active {
+			continue
+		}
+		for _, entry := range service.Entries() {
+			member, ok := fleet.Get(entry)
+			if !ok || !member.Healthy {
+				fmt.Printf("error reaching proxy %s: %v\n", entry, member.LastError)
 				continue
 			}
+			proxy := member.Proxy
 			// Reconfigure Proxy to new instance
-			err = proxy.Create(service.EntryPort, service.ServicePort, service.ServiceIP, serviceUUID)
+			err := proxy.CreateTunnel(ctx, service.Tunnel(serviceUUID), pcsdk.ServiceTunnel(service))
+			if errors.Is(err, pcsdk.ErrTunnelExists) {
+				// tunnel survived a restart of Polemos, make sure it points at the current instance
+				err = proxy.ModifyTunnel(ctx, service.Tunnel(serviceUUID), pcsdk.ServiceTunnel(service))
+			}
 			if err != nil {
+				fmt.Printf("error executing create command: %s\n", err)
 				continue
 			}
 		}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/state"
+)
+
+func testConfig(t *testing.T, s *pcsdktest.Server, key string) state.Config {
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	config.MTD.ManagementPort = s.Addr().Port()
+	config.MTD.SigningKey = key
+	config.MTD.NoncePath = filepath.Join(t.TempDir(), "nonces.yaml")
+	return config
+}
+
+func TestCreateTunnels(t *testing.T) {
+	s := pcsdktest.NewSignedServer("secret", 0)
+	defer s.Close()
+	config := testConfig(t, s, "secret")
+
+	active := state.CustomUUID(uuid.New())
+	inactive := state.CustomUUID(uuid.New())
+	existing := state.CustomUUID(uuid.New())
+	entry := s.Addr().Addr()
+	config.MTD.Services[active] = state.Service{AdminEnabled: true, Active: true, EntryIP: entry, EntryPort: 5555,
+		ServiceIP: netip.MustParseAddr("10.0.0.1"), ServicePort: 80}
+	config.MTD.Services[inactive] = state.Service{AdminEnabled: true, Active: false, EntryIP: entry, EntryPort: 5556,
+		ServiceIP: netip.MustParseAddr("10.0.0.2"), ServicePort: 80}
+	config.MTD.Services[existing] = state.Service{AdminEnabled: true, Active: true, EntryIP: entry, EntryPort: 5557,
+		ServiceIP: netip.MustParseAddr("10.0.0.3"), ServicePort: 80}
+	// stale tunnel left over from an earlier run
+	s.SetTunnel(existing, pcsdk.Tunnel{IncomingPort: 5557, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.99")})
+
+	fleet := pcsdk.NewFleet(config)
+	fleet.Refresh(context.Background())
+	createTunnels(config, fleet)
+
+	tunnels := s.Tunnels()
+	if len(tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels, got %+v", tunnels)
+	}
+	expected := pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")}
+	if !tunnels[active].Matches(expected) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", expected, tunnels[active])
+	}
+	if tunnels[existing].DestinationIP != netip.MustParseAddr("10.0.0.3") {
+		t.Fatalf("expected existing tunnel to be modified, got %+v", tunnels[existing])
+	}
+}
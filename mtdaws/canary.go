@@ -0,0 +1,120 @@
+package mtdaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+// ErrCanaryFailed is returned when the new instance of a service failed too many connections during a canary move
+var ErrCanaryFailed = errors.New("canary failed")
+
+// canary shifts new connections of a service from its previous instance to its current one in the configured steps on
+// every entry proxy, watching the failures they report for the current instance. The service keeps its weighted
+// backends in config while the canary runs. If the current instance fails too often the tunnels are pointed back at
+// the previous instance and ErrCanaryFailed is returned, on any other error they are pointed back too
+func canary(ctx context.Context, proxies []pcsdk.Proxy, config state.Config, serviceUUID state.CustomUUID, previous netip.Addr) (state.Config, error) {
+	steps := config.MTD.Canary.Steps
+	if len(steps) == 0 {
+		return config, nil
+	}
+	// every proxy has to split connections, otherwise the canary is skipped before shifting any of them
+	for _, proxy := range proxies {
+		err := proxy.Require(ctx, pcsdk.CapabilityWeighted)
+		if errors.Is(err, pcsdk.ErrUnsupported) {
+			fmt.Printf("Proxy %s does not support weighted backends, skipping canary\n", proxy.Addr().Addr())
+			return config, nil
+		}
+		if err != nil {
+			return config, err
+		}
+	}
+	service := config.MTD.Services[serviceUUID]
+	defer func() {
+		// the final switch is done with a single destination
+		s := config.MTD.Services[serviceUUID]
+		s.Backends = nil
+		config.MTD.Services[serviceUUID] = s
+	}()
+	abort := func(err error) (state.Config, error) {
+		rerr := rollback(ctx, proxies, serviceUUID, service, previous)
+		if rerr != nil {
+			return config, fmt.Errorf("%w, rollback failed: %w", err, rerr)
+		}
+		return config, err
+	}
+
+	for _, weight := range steps {
+		if weight > 100 {
+			weight = 100
+		}
+		t := time.Now()
+		service.Backends = []state.Backend{
+			{IP: previous, Port: service.ServicePort, Weight: 100 - weight},
+			{IP: service.ServiceIP, Port: service.ServicePort, Weight: weight},
+		}
+		config.MTD.Services[serviceUUID] = service
+		for _, proxy := range proxies {
+			err := proxy.ModifyTunnel(ctx, service.Tunnel(serviceUUID), pcsdk.ServiceTunnel(service))
+			if err != nil {
+				return abort(fmt.Errorf("error shifting weight to new instance on %s: %w", proxy.Addr().Addr(), err))
+			}
+		}
+		fmt.Printf("Canary at %d%%. (took %s)\n", weight, time.Since(t).Round(100*time.Millisecond).String())
+
+		select {
+		case <-ctx.Done():
+			return abort(ctx.Err())
+		case <-time.After(time.Duration(config.MTD.Canary.StepDuration) * time.Second):
+		}
+
+		var failures uint64
+		for _, proxy := range proxies {
+			f, err := backendFailures(ctx, proxy, service.Tunnel(serviceUUID), service.ServiceIP)
+			if err != nil {
+				return abort(err)
+			}
+			failures += f
+		}
+		if failures > config.MTD.Canary.MaxFailures {
+			return abort(fmt.Errorf("%w: %d failed connections at %d%%", ErrCanaryFailed, failures, weight))
+		}
+	}
+	return config, nil
+}
+
+// rollback points the tunnel of a service on every entry proxy back at its previous instance only
+func rollback(ctx context.Context, proxies []pcsdk.Proxy, serviceUUID state.CustomUUID, service state.Service, previous netip.Addr) error {
+	service.ServiceIP = previous
+	service.Backends = nil
+	for _, proxy := range proxies {
+		err := proxy.ModifyTunnel(ctx, service.Tunnel(serviceUUID), pcsdk.ServiceTunnel(service))
+		if err != nil {
+			return fmt.Errorf("error pointing %s back at previous instance: %w", proxy.Addr().Addr(), err)
+		}
+	}
+	return nil
+}
+
+// backendFailures returns the number of failed connections the proxy reports for a backend of a tunnel
+func backendFailures(ctx context.Context, proxy pcsdk.Proxy, id state.CustomUUID, ip netip.Addr) (uint64, error) {
+	status, err := proxy.Status(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error executing status command: %w", err)
+	}
+	tunnel, ok := status.Tunnels[id]
+	if !ok {
+		return 0, fmt.Errorf("%w: tunnel disappeared during canary", pcsdk.ErrTunnelNotFound)
+	}
+	for _, b := range tunnel.Backends {
+		if b.IP == ip {
+			return b.Failures, nil
+		}
+	}
+	return 0, errors.New("proxy is not forwarding to new instance")
+}
@@ -1,6 +1,8 @@
 package mtdaws
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/netip"
 	"time"
@@ -10,11 +12,12 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/google/uuid"
 	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/reconcile"
 	"github.com/thefeli73/polemos/state"
 )
 
 // AWSMoveInstance moves a specified instance to a new availability region
-func AWSMoveInstance(config state.Config) (state.Config) {
+func AWSMoveInstance(config state.Config, fleet *pcsdk.ProxyFleet) (state.Config) {
 
 	// pseudorandom instance from all services for testing
 	var serviceUUID state.CustomUUID
@@ -29,15 +32,26 @@ func AWSMoveInstance(config state.Config) (state.Config) {
 
 	fmt.Println("MTD move service:\t", uuid.UUID.String(uuid.UUID(serviceUUID)))
 
-	// Test Proxy Connection
+	// Test Proxy Connections, every entry proxy in rotation is moved along
 	t := time.Now()
-	proxy := pcsdk.BuildProxy(netip.AddrPortFrom(instance.EntryIP, config.MTD.ManagementPort))
-	err := proxy.Status()
-	if err != nil {
-		fmt.Printf("error executing test command: %s\n", err)
+	proxies := entryProxies(fleet, instance)
+	if len(proxies) == 0 {
+		fmt.Println("Error, service has no entry proxy in rotation")
 		return config
 	}
-	fmt.Printf("Proxy Tested. (took %s)\n", time.Since(t).Round(100*time.Millisecond).String())
+	for _, proxy := range proxies {
+		status, err := proxy.Status(context.TODO())
+		if err != nil {
+			fmt.Printf("error executing test command: %s\n", err)
+			return config
+		}
+		if tunnel, ok := status.Tunnels[instance.Tunnel(serviceUUID)]; ok {
+			fmt.Printf("Proxy %s forwarding :%d/%s -> %s:%d (%s)\n", proxy.Addr().Addr(), tunnel.IncomingPort, tunnel.Network(), tunnel.DestinationIP, tunnel.DestinationPort, tunnel.Usage())
+		} else {
+			fmt.Printf("Proxy %s has no tunnel for service\n", proxy.Addr().Addr())
+		}
+	}
+	fmt.Printf("Proxies Tested. (took %s)\n", time.Since(t).Round(100*time.Millisecond).String())
 	region, instanceID := DecodeCloudID(instance.CloudID)
 	awsConfig := NewConfig(region, config.AWS.CredentialsPath)
 	svc := ec2.NewFromConfig(awsConfig)
@@ -72,7 +86,7 @@ func AWSMoveInstance(config state.Config) (state.Config) {
 
 	// Launch new instance
 	t = time.Now()
-	newInstanceID, err := launchInstance(svc, realInstance, imageName, region)
+	newInstanceID, err := launchInstance(svc, realInstance, imageName, region, "")
 	if err != nil {
 		fmt.Println("Error launching instance:\t", err)
 		return config
@@ -91,14 +105,25 @@ func AWSMoveInstance(config state.Config) (state.Config) {
 	// update local config to match new instance
 	config = AWSUpdateService(config, region, serviceUUID, newInstanceID)
 
-	// Reconfigure Proxy to new instance
-	t = time.Now()
-	err = proxy.Modify(config.MTD.Services[serviceUUID].ServicePort, config.MTD.Services[serviceUUID].ServiceIP, serviceUUID)
+	// Shift new connections to the new instance step by step, keeping the old one if it fails for any reason
+	config, err = canary(context.TODO(), proxies, config, serviceUUID, instance.ServiceIP)
+	if err != nil {
+		fmt.Printf("error moving service: %s\n", err)
+		config.MTD.Services[serviceUUID] = instance
+		cleanupAWS(svc, config, newInstanceID, imageName)
+		return config
+	}
+
+	// Reconfigure Proxies to new instance and let connections to the old one drain
+	err = switchProxy(context.TODO(), proxies, config, serviceUUID)
 	if err != nil {
-		fmt.Printf("error executing modify command: %s\n", err)
+		// the config already points at the new instance, the old one is cleaned up once the reconciler converged
+		fmt.Printf("error switching proxy: %s\n", err)
+		s := config.MTD.Services[serviceUUID]
+		s.RetiredInstances = append(s.RetiredInstances, state.RetiredInstance{CloudID: instance.CloudID, Image: imageName})
+		config.MTD.Services[serviceUUID] = s
 		return config
 	}
-	fmt.Printf("Proxy modified. (took %s)\n", time.Since(t).Round(100*time.Millisecond).String())
 
 	// take care of old instance, deregister image and delete snapshot
 	cleanupAWS(svc, config, instanceID, imageName)
@@ -106,6 +131,131 @@ func AWSMoveInstance(config state.Config) (state.Config) {
 	return config
 }
 
+// entryProxies returns the entry proxies of a service that are in rotation, as far as the fleet knows them yet
+func entryProxies(fleet *pcsdk.ProxyFleet, service state.Service) []pcsdk.Proxy {
+	var proxies []pcsdk.Proxy
+	for _, entry := range service.Rotation() {
+		member, ok := fleet.Get(entry)
+		if !ok {
+			fmt.Printf("Proxy %s is not part of the fleet yet\n", entry)
+			continue
+		}
+		proxies = append(proxies, member.Proxy)
+	}
+	return proxies
+}
+
+// switchProxy points the tunnels of a service on every entry proxy at its current instance, verifies them and waits
+// for connections to the previous instance to drain so it can safely be terminated. This includes the tunnels still
+// forwarding ports the service hopped away from. Proxies left behind by an error are converged by the reconciler, as
+// the config already points at the current instance
+func switchProxy(ctx context.Context, proxies []pcsdk.Proxy, config state.Config, serviceUUID state.CustomUUID) error {
+	service := config.MTD.Services[serviceUUID]
+	grace := time.Duration(config.MTD.DrainGrace) * time.Second
+	// modify all settings of the tunnels, so e.g. allowed sources are kept across the move
+	tunnels := reconcile.ServiceTunnels(serviceUUID, service, time.Now())
+
+	draining := make([][]state.CustomUUID, len(proxies))
+	for i, proxy := range proxies {
+		t := time.Now()
+		for id, tunnel := range tunnels {
+			var err error
+			if grace > 0 {
+				err = proxy.ModifyTunnelDrain(ctx, id, tunnel, grace)
+				if errors.Is(err, pcsdk.ErrUnsupported) {
+					fmt.Println("Proxy does not support draining, switching immediately")
+					err = proxy.ModifyTunnel(ctx, id, tunnel)
+				} else if err == nil {
+					draining[i] = append(draining[i], id)
+				}
+			} else {
+				err = proxy.ModifyTunnel(ctx, id, tunnel)
+			}
+			if err != nil {
+				return fmt.Errorf("error executing modify command on %s: %w", proxy.Addr().Addr(), err)
+			}
+		}
+		fmt.Printf("Proxy %s modified. (took %s)\n", proxy.Addr().Addr(), time.Since(t).Round(100*time.Millisecond).String())
+
+		// Verify proxy is forwarding to new instance
+		err := forwarding(ctx, proxy, serviceUUID, service)
+		if err != nil {
+			return err
+		}
+	}
+
+	// all proxies drain at the same time, so the grace period is shared
+	deadline := time.Now().Add(grace)
+	for i, proxy := range proxies {
+		if len(draining[i]) == 0 {
+			continue
+		}
+		t := time.Now()
+		for _, id := range draining[i] {
+			open, err := proxy.WaitDrained(ctx, id, time.Until(deadline), 0)
+			if err != nil {
+				return fmt.Errorf("error waiting for drain on %s: %w", proxy.Addr().Addr(), err)
+			}
+			if open > 0 {
+				fmt.Printf("Drain grace period over, cutting %d connections\n", open)
+			}
+		}
+		fmt.Printf("Old instance drained on %s. (took %s)\n", proxy.Addr().Addr(), time.Since(t).Round(100*time.Millisecond).String())
+	}
+	return nil
+}
+
+// forwarding returns an error unless the proxy forwards the tunnel of a service to its current instance
+func forwarding(ctx context.Context, proxy pcsdk.Proxy, serviceUUID state.CustomUUID, service state.Service) error {
+	status, err := proxy.Status(ctx)
+	if err != nil {
+		return fmt.Errorf("error executing status command on %s: %w", proxy.Addr().Addr(), err)
+	}
+	tunnel := pcsdk.ServiceTunnel(service)
+	have, ok := status.Tunnels[service.Tunnel(serviceUUID)]
+	if !ok || have.DestinationIP != service.ServiceIP {
+		return fmt.Errorf("proxy %s is not forwarding to new instance", proxy.Addr().Addr())
+	}
+	if have.Network() != tunnel.Network() {
+		return fmt.Errorf("proxy %s is forwarding %s, service is %s", proxy.Addr().Addr(), have.Network(), tunnel.Network())
+	}
+	return nil
+}
+
+// AWSCleanupRetired cleans up the previous instances of services whose move was interrupted, once the reconciler
+// converged every entry proxy in rotation to the current instance
+func AWSCleanupRetired(config state.Config, fleet *pcsdk.ProxyFleet) state.Config {
+	for serviceUUID, service := range config.MTD.Services {
+		if len(service.RetiredInstances) == 0 {
+			continue
+		}
+		err := converged(context.TODO(), entryProxies(fleet, service), serviceUUID, service)
+		if err != nil {
+			fmt.Printf("Keeping %d previous instances of %s: %s\n", len(service.RetiredInstances), uuid.UUID(serviceUUID), err)
+			continue
+		}
+		for _, retired := range service.RetiredInstances {
+			region, instanceID := DecodeCloudID(retired.CloudID)
+			svc := ec2.NewFromConfig(NewConfig(region, config.AWS.CredentialsPath))
+			cleanupAWS(svc, config, instanceID, retired.Image)
+		}
+		service.RetiredInstances = nil
+		config.MTD.Services[serviceUUID] = service
+	}
+	return config
+}
+
+// converged returns an error unless every proxy forwards the tunnel of a service to its current instance
+func converged(ctx context.Context, proxies []pcsdk.Proxy, serviceUUID state.CustomUUID, service state.Service) error {
+	for _, proxy := range proxies {
+		err := forwarding(ctx, proxy, serviceUUID, service)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AWSUpdateService updates a specified service config to match a newly moved instance
 func AWSUpdateService(config state.Config, region string, service state.CustomUUID, newInstanceID string) (state.Config) {
 	awsConfig := NewConfig(region, config.AWS.CredentialsPath)
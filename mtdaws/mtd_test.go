@@ -0,0 +1,275 @@
+package mtdaws
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/state"
+)
+
+func movedService(s *pcsdktest.Server) (state.Config, state.CustomUUID) {
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	id := state.CustomUUID(uuid.New())
+	config.MTD.Services[id] = state.Service{AdminEnabled: true, Active: true, EntryIP: s.Addr().Addr(), EntryPort: 5555,
+		ServiceIP: netip.MustParseAddr("10.0.0.2"), ServicePort: 80}
+	s.SetTunnel(id, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	return config, id
+}
+
+func TestSwitchProxyWaitsForDrain(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := movedService(s)
+	config.MTD.DrainGrace = 10
+	s.SetDraining(id, 3)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.SetDraining(id, 0)
+	}()
+
+	t0 := time.Now()
+	err := switchProxy(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if time.Since(t0) < 100*time.Millisecond {
+		t.Fatalf("expected switch to wait for open connections")
+	}
+	if s.Tunnels()[id].DestinationIP != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("tunnel not switched, got %+v", s.Tunnels()[id])
+	}
+}
+
+func TestSwitchProxyWithoutDrainSupport(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	s.SetCapabilities(pcsdk.CapabilityBatch)
+	config, id := movedService(s)
+	config.MTD.DrainGrace = 10
+	s.SetDraining(id, 3)
+
+	err := switchProxy(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if tunnel := s.Tunnels()[id]; tunnel.DestinationIP != netip.MustParseAddr("10.0.0.2") || tunnel.Draining != 0 {
+		t.Fatalf("expected immediate switch, got %+v", tunnel)
+	}
+}
+
+func TestSwitchProxyKeepsAllowedSources(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := movedService(s)
+	service := config.MTD.Services[id]
+	service.AllowedSources = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	config.MTD.Services[id] = service
+
+	err := switchProxy(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if !s.Tunnels()[id].Matches(pcsdk.ServiceTunnel(service)) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", pcsdk.ServiceTunnel(service), s.Tunnels()[id])
+	}
+}
+
+func TestSwitchProxyKeepsProxyProtocol(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := movedService(s)
+	service := config.MTD.Services[id]
+	service.ProxyProtocol = pcsdk.ProxyProtocolV2
+	config.MTD.Services[id] = service
+	s.SetTunnel(id, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1"),
+		ProxyProtocol: pcsdk.ProxyProtocolV2})
+
+	err := switchProxy(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if !s.Tunnels()[id].Matches(pcsdk.ServiceTunnel(service)) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", pcsdk.ServiceTunnel(service), s.Tunnels()[id])
+	}
+}
+
+func TestSwitchProxyMovesRetiredPorts(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := movedService(s)
+	config.MTD.DrainGrace = 10
+	// the service hopped from 5555 to 30000, the tunnel of the old port still forwards it during the overlap
+	service := config.MTD.Services[id]
+	service.TunnelID = state.CustomUUID(uuid.New())
+	service.EntryPort = 30000
+	service.RetiredPorts = []state.RetiredPort{{Port: 5555, Until: time.Now().Add(time.Minute), TunnelID: id}}
+	config.MTD.Services[id] = service
+	s.SetTunnel(service.TunnelID, pcsdk.Tunnel{IncomingPort: 30000, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	s.SetDraining(id, 3)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.SetDraining(id, 0)
+	}()
+
+	t0 := time.Now()
+	err := switchProxy(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if time.Since(t0) < 100*time.Millisecond {
+		t.Fatalf("expected switch to wait for open connections on the retired port")
+	}
+	for _, tunnelID := range []state.CustomUUID{id, service.TunnelID} {
+		if s.Tunnels()[tunnelID].DestinationIP != netip.MustParseAddr("10.0.0.2") {
+			t.Fatalf("tunnel not switched, got %+v", s.Tunnels())
+		}
+	}
+	if s.Tunnels()[id].IncomingPort != 5555 {
+		t.Fatalf("expected retired port to be kept, got %+v", s.Tunnels()[id])
+	}
+}
+
+func TestCanaryShiftsWeight(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := movedService(s)
+	config.MTD.Canary.Steps = []uint32{10, 50}
+
+	config, err := canary(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id, netip.MustParseAddr("10.0.0.1"))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	expected := []pcsdk.Backend{
+		{IP: netip.MustParseAddr("10.0.0.1"), Port: 80, Weight: 50},
+		{IP: netip.MustParseAddr("10.0.0.2"), Port: 80, Weight: 50},
+	}
+	tunnel := pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.2"), Backends: expected}
+	if !s.Tunnels()[id].Matches(tunnel) {
+		t.Fatalf("expected last canary step, got %+v", s.Tunnels()[id])
+	}
+	if config.MTD.Services[id].Backends != nil {
+		t.Fatalf("expected backends to be cleared after canary, got %+v", config.MTD.Services[id].Backends)
+	}
+}
+
+func TestCanaryRollsBack(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := movedService(s)
+	config.MTD.Canary.Steps = []uint32{10, 50}
+	config.MTD.Canary.MaxFailures = 2
+	config.MTD.Canary.StepDuration = 1
+	go func() {
+		// fail connections to the new instance as soon as it gets weight
+		for len(s.Tunnels()[id].Backends) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		s.SetBackendFailures(id, netip.MustParseAddr("10.0.0.2"), 3)
+	}()
+
+	_, err := canary(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id, netip.MustParseAddr("10.0.0.1"))
+	if !errors.Is(err, ErrCanaryFailed) {
+		t.Fatalf("expected canary to fail, got %v", err)
+	}
+	tunnel := pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")}
+	if !s.Tunnels()[id].Matches(tunnel) {
+		t.Fatalf("expected rollback to previous instance, got %+v", s.Tunnels()[id])
+	}
+}
+
+func TestCanaryRollsBackOnError(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	broken := pcsdktest.NewServer()
+	defer broken.Close()
+	config, id := movedService(s)
+	config.MTD.Canary.Steps = []uint32{10, 50}
+
+	// the second proxy has no tunnel, so shifting weight fails after the first one took it
+	_, err := canary(context.Background(), []pcsdk.Proxy{s.Proxy(), broken.Proxy()}, config, id, netip.MustParseAddr("10.0.0.1"))
+	if !errors.Is(err, pcsdk.ErrTunnelNotFound) {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", pcsdk.ErrTunnelNotFound, err)
+	}
+	tunnel := pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")}
+	if !s.Tunnels()[id].Matches(tunnel) {
+		t.Fatalf("expected rollback to previous instance, got %+v", s.Tunnels()[id])
+	}
+}
+
+func TestCanaryWithoutWeightedSupport(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	s.SetCapabilities(pcsdk.CapabilityBatch, pcsdk.CapabilityDrain)
+	config, id := movedService(s)
+	config.MTD.Canary.Steps = []uint32{10, 50}
+
+	_, err := canary(context.Background(), []pcsdk.Proxy{s.Proxy()}, config, id, netip.MustParseAddr("10.0.0.1"))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if s.Tunnels()[id].DestinationIP != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("expected tunnel to be left for switchProxy, got %+v", s.Tunnels()[id])
+	}
+}
+
+func TestCanaryChecksEveryProxy(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	old := pcsdktest.NewServer()
+	defer old.Close()
+	old.SetCapabilities(pcsdk.CapabilityBatch, pcsdk.CapabilityDrain)
+	config, id := movedService(s)
+	old.SetTunnel(id, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	config.MTD.Canary.Steps = []uint32{10, 50}
+
+	_, err := canary(context.Background(), []pcsdk.Proxy{s.Proxy(), old.Proxy()}, config, id, netip.MustParseAddr("10.0.0.1"))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if len(s.Tunnels()[id].Backends) != 0 {
+		t.Fatalf("expected no weight shifted when a proxy can not split connections, got %+v", s.Tunnels()[id])
+	}
+}
+
+func TestConverged(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := movedService(s)
+	proxies := []pcsdk.Proxy{s.Proxy()}
+
+	err := converged(context.Background(), proxies, id, config.MTD.Services[id])
+	if err == nil {
+		t.Fatalf("expected proxy still forwarding to the previous instance not to be converged")
+	}
+	s.SetTunnel(id, pcsdk.ServiceTunnel(config.MTD.Services[id]))
+	err = converged(context.Background(), proxies, id, config.MTD.Services[id])
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+}
+
+func TestSwitchProxyUpdatesEveryEntry(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	redundant := pcsdktest.NewServer()
+	defer redundant.Close()
+	config, id := movedService(s)
+	redundant.SetTunnel(id, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+
+	err := switchProxy(context.Background(), []pcsdk.Proxy{s.Proxy(), redundant.Proxy()}, config, id)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	for _, server := range []*pcsdktest.Server{s, redundant} {
+		if server.Tunnels()[id].DestinationIP != netip.MustParseAddr("10.0.0.2") {
+			t.Fatalf("tunnel not switched on %s, got %+v", server.Addr(), server.Tunnels()[id])
+		}
+	}
+}
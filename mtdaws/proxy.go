@@ -0,0 +1,247 @@
+package mtdaws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/thefeli73/polemos/bootstrap"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/reconcile"
+	"github.com/thefeli73/polemos/state"
+)
+
+// ErrNoElasticIP is returned when moving a proxy whose entry is not an elastic ip. Its entry would change, and neither
+// the clients resolving it nor its certificate issued for the old entry would follow without a DNS update
+var ErrNoElasticIP = errors.New("proxy has no elastic ip to keep its entry")
+
+// AWSMoveProxies moves the entry proxy that was moved the longest time ago, if it is due. Only proxies whose entry is
+// an elastic ip are moved
+func AWSMoveProxies(config state.Config, fleet *pcsdk.ProxyFleet) state.Config {
+	interval := time.Duration(config.MTD.ProxyMove.Interval) * time.Minute
+	if interval == 0 {
+		return config
+	}
+	var due []netip.Addr
+	for entry, proxy := range config.MTD.Proxies {
+		if proxy.CloudID != "" && proxy.AllocationID != "" && time.Since(proxy.MovedAt) >= interval {
+			due = append(due, entry)
+		}
+	}
+	if len(due) == 0 {
+		return config
+	}
+	sort.Slice(due, func(i, j int) bool {
+		a, b := config.MTD.Proxies[due[i]].MovedAt, config.MTD.Proxies[due[j]].MovedAt
+		if a.Equal(b) {
+			return due[i].Less(due[j])
+		}
+		return a.Before(b)
+	})
+
+	config, err := AWSMoveProxy(config, fleet, due[0])
+	if err != nil {
+		fmt.Printf("error moving proxy %s: %s\n", due[0], err)
+	}
+	return config
+}
+
+// AWSMoveProxy launches a replacement for the proxy instance on entry, replays all its tunnels onto it, moves the
+// elastic ip of the entry over to it and retires the old instance. Connections open through the old instance are cut
+// by the move
+func AWSMoveProxy(config state.Config, fleet *pcsdk.ProxyFleet, entry netip.Addr) (state.Config, error) {
+	settings := config.MTD.Proxies[entry]
+	if settings.AllocationID == "" {
+		return config, ErrNoElasticIP
+	}
+	fmt.Println("MTD move proxy:\t", entry)
+	member, ok := fleet.Get(entry)
+	if !ok {
+		return config, errors.New("proxy is not part of the fleet yet")
+	}
+
+	// Test Proxy Connection
+	t := time.Now()
+	old := member.Proxy
+	status, err := old.Status(context.TODO())
+	if err != nil {
+		return config, fmt.Errorf("error executing status command: %w", err)
+	}
+	fmt.Printf("Proxy Tested, %d tunnels. (took %s)\n", len(status.Tunnels), time.Since(t).Round(100*time.Millisecond).String())
+
+	region, instanceID := DecodeCloudID(settings.CloudID)
+	awsConfig := NewConfig(region, config.AWS.CredentialsPath)
+	svc := ec2.NewFromConfig(awsConfig)
+
+	realInstance, err := getInstanceDetailsFromString(svc, instanceID)
+	if err != nil {
+		return config, fmt.Errorf("error getting instance details: %w", err)
+	}
+	if !isInstanceRunning(realInstance) {
+		return config, errors.New("proxy instance is not running")
+	}
+
+	// Install a fresh proxy from the base image if bootstrapping is enabled, otherwise duplicate the old one
+	var imageName, imageID, userData string
+	if bootstrap.Enabled(config, region) {
+		userData, err = proxyUserData(config, entry)
+		if err != nil {
+			return config, fmt.Errorf("error generating user data: %w", err)
+		}
+		imageID = config.MTD.Bootstrap.Images[region]
+	} else {
+		//Create image
+		t = time.Now()
+		imageName, err = createImage(svc, instanceID)
+		if err != nil {
+			return config, fmt.Errorf("error creating image: %w", err)
+		}
+		fmt.Printf("Created image:\t\t%s (took %s)\n", imageName, time.Since(t).Round(100*time.Millisecond).String())
+
+		// Wait for image
+		t = time.Now()
+		err = waitForImageReady(svc, imageName, 5*time.Minute)
+		if err != nil {
+			return config, fmt.Errorf("error waiting for image to be ready: %w", err)
+		}
+		fmt.Printf("Image is ready:\t\t%s (took %s)\n", imageName, time.Since(t).Round(100*time.Millisecond).String())
+		imageID = imageName
+	}
+
+	// Launch new instance
+	t = time.Now()
+	newInstanceID, err := launchInstance(svc, realInstance, imageID, region, userData)
+	if err != nil {
+		return config, fmt.Errorf("error launching instance: %w", err)
+	}
+	fmt.Printf("Launched new instance:\t%s (took %s)\n", newInstanceID, time.Since(t).Round(100*time.Millisecond).String())
+
+	// Wait for instance
+	t = time.Now()
+	err = waitForInstanceReady(svc, newInstanceID, 5*time.Minute)
+	if err != nil {
+		retire(svc, config, newInstanceID, imageName)
+		return config, fmt.Errorf("error waiting for instance to be ready: %w", err)
+	}
+	fmt.Printf("instance is ready:\t\t%s (took %s)\n", newInstanceID, time.Since(t).Round(100*time.Millisecond).String())
+
+	newInstance, err := getInstanceDetailsFromString(svc, newInstanceID)
+	if err != nil || newInstance.PublicIpAddress == nil {
+		retire(svc, config, newInstanceID, imageName)
+		return config, fmt.Errorf("new proxy instance has no public ip: %v", err)
+	}
+	addr, err := netip.ParseAddr(aws.ToString(newInstance.PublicIpAddress))
+	if err != nil {
+		retire(svc, config, newInstanceID, imageName)
+		return config, fmt.Errorf("error converting ip: %w", err)
+	}
+
+	// Wait for the proxy on the new instance and give it every tunnel of the old one
+	t = time.Now()
+	proxy := proxyAt(old, entry, addr)
+	err = bootstrap.Wait(context.TODO(), proxy, bootstrap.Timeout(config), 0)
+	if err != nil {
+		retire(svc, config, newInstanceID, imageName)
+		return config, fmt.Errorf("error waiting for new proxy: %w", err)
+	}
+	fmt.Printf("New proxy is up:\t%s (took %s)\n", addr, time.Since(t).Round(100*time.Millisecond).String())
+	t = time.Now()
+	err = replayTunnels(context.TODO(), proxy, status.Tunnels)
+	if err != nil {
+		retire(svc, config, newInstanceID, imageName)
+		return config, fmt.Errorf("error replaying tunnels: %w", err)
+	}
+	fmt.Printf("Replayed %d tunnels. (took %s)\n", len(status.Tunnels), time.Since(t).Round(100*time.Millisecond).String())
+
+	// Swap the entry over to the new proxy. The old one is only reachable on the entry, so it can not be drained and
+	// connections still open through it are cut
+	t = time.Now()
+	open := openConnections(status)
+	if current, err := old.Status(context.TODO()); err == nil {
+		open = openConnections(current)
+	}
+	cloudID := GetCloudID(AwsInstance{InstanceID: newInstanceID, Region: region})
+	err = associateAddress(svc, settings.AllocationID, newInstanceID)
+	if err != nil {
+		retire(svc, config, newInstanceID, imageName)
+		return config, fmt.Errorf("error associating elastic ip: %w", err)
+	}
+	settings.CloudID = cloudID
+	settings.MovedAt = time.Now()
+	config.MTD.Proxies[entry] = settings
+	// the entry answers with the boot id of the new proxy now, a planned move and not a restart losing its tunnels
+	fleet.Replaced(entry)
+	reconcile.Replaced(config.ManagementAddr(entry))
+	pcsdk.ForgetCapabilities(config.ManagementAddr(entry))
+	fmt.Printf("Swapped entry to new proxy:\t%s (took %s)\n", newInstanceID, time.Since(t).Round(100*time.Millisecond).String())
+	if open > 0 {
+		fmt.Printf("Cut %d connections through the old proxy\n", open)
+	}
+
+	// take care of old instance, deregister image and delete snapshot
+	retire(svc, config, instanceID, imageName)
+
+	return config, nil
+}
+
+// proxyAt returns the proxy on addr using the settings of old, the proxy on entry, e.g. a replacement not yet on the entry
+func proxyAt(old pcsdk.Proxy, entry netip.Addr, addr netip.Addr) pcsdk.Proxy {
+	// its certificate is issued for the entry it takes over
+	return old.WithAddr(netip.AddrPortFrom(addr, old.Addr().Port())).WithServerName(entry.String())
+}
+
+// proxyUserData returns the user data bootstrapping the replacement of the proxy on entry, which keeps the entry
+func proxyUserData(config state.Config, entry netip.Addr) (string, error) {
+	bundle, err := bootstrap.Prepare(config, entry)
+	if err != nil {
+		return "", err
+	}
+	return bootstrap.UserData(config, bundle)
+}
+
+// retire terminates an instance, and if it was launched from one also deregisters the image and deletes its snapshot
+func retire(svc *ec2.Client, config state.Config, instanceID string, imageName string) {
+	if imageName != "" {
+		cleanupAWS(svc, config, instanceID, imageName)
+		return
+	}
+	t := time.Now()
+	err := terminateInstance(svc, instanceID)
+	if err != nil {
+		fmt.Println("Error terminating instance:\t", err)
+		return
+	}
+	fmt.Printf("Killed old instance:\t%s (took %s)\n", instanceID, time.Since(t).Round(100*time.Millisecond).String())
+}
+
+// replayTunnels creates the tunnels on a proxy, modifying those it already has, e.g. from the image it was launched from
+func replayTunnels(ctx context.Context, proxy pcsdk.Proxy, tunnels map[state.CustomUUID]pcsdk.Tunnel) error {
+	status, err := proxy.Status(ctx)
+	if err != nil {
+		return err
+	}
+	batch := proxy.Batch()
+	for id, tunnel := range tunnels {
+		if _, ok := status.Tunnels[id]; ok {
+			batch.ModifyTunnel(id, tunnel)
+		} else {
+			batch.CreateTunnel(id, tunnel)
+		}
+	}
+	_, err = batch.Execute(ctx)
+	return err
+}
+
+// openConnections returns the connections open through every tunnel of a proxy
+func openConnections(status pcsdk.ProxyStatus) uint64 {
+	var open uint64
+	for _, tunnel := range status.Tunnels {
+		open += tunnel.Connections
+	}
+	return open
+}
@@ -0,0 +1,52 @@
+package mtdaws
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/state"
+)
+
+func TestMoveRequiresElasticIP(t *testing.T) {
+	entry := netip.MustParseAddr("192.0.2.1")
+	var config state.Config
+	config.MTD.ProxyMove.Interval = 1
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{entry: {CloudID: "aws_eu-north-1_i-old"}}
+
+	_, err := AWSMoveProxy(config, pcsdk.NewFleet(config), entry)
+	if !errors.Is(err, ErrNoElasticIP) {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", ErrNoElasticIP, err)
+	}
+	// the proxy is never due, so nothing is launched for it
+	config = AWSMoveProxies(config, pcsdk.NewFleet(config))
+	if !config.MTD.Proxies[entry].MovedAt.IsZero() || config.MTD.Proxies[entry].CloudID != "aws_eu-north-1_i-old" {
+		t.Fatalf("expected proxy without elastic ip to stay, got %+v", config.MTD.Proxies[entry])
+	}
+}
+
+func TestReplayTunnels(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	created := state.CustomUUID(uuid.New())
+	existing := state.CustomUUID(uuid.New())
+	s.SetTunnel(existing, pcsdk.Tunnel{IncomingPort: 5556, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.99")})
+
+	tunnels := map[state.CustomUUID]pcsdk.Tunnel{
+		created:  {IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1"), ProxyProtocol: pcsdk.ProxyProtocolV1},
+		existing: {IncomingPort: 5556, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.2")},
+	}
+	err := replayTunnels(context.Background(), s.Proxy(), tunnels)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	for id, expected := range tunnels {
+		if got := s.Tunnels()[id]; !got.Matches(expected) {
+			t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", expected, got)
+		}
+	}
+}
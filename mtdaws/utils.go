@@ -2,6 +2,7 @@ package mtdaws
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -157,7 +158,8 @@ func waitForInstanceReady(svc *ec2.Client, newInstanceID string, timeout time.Du
 }
 
 // launchInstance launches a instance IN RANDOM AVAILABILITY ZONE within the same region, based on an oldInstance and AMI (duplicating the instance)
-func launchInstance(svc *ec2.Client, oldInstance *types.Instance, imageID string, region string) (string, error) {
+// userData is passed on to cloud-init of the new instance if not empty
+func launchInstance(svc *ec2.Client, oldInstance *types.Instance, imageID string, region string, userData string) (string, error) {
 	securityGroupIds := make([]string, len(oldInstance.SecurityGroups))
 	for i, sg := range oldInstance.SecurityGroups {
 		securityGroupIds[i] = aws.ToString(sg.GroupId)
@@ -197,6 +199,10 @@ func launchInstance(svc *ec2.Client, oldInstance *types.Instance, imageID string
 		},
 	}
 
+	if userData != "" {
+		input.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(userData)))
+	}
+
 	output, err := svc.RunInstances(context.TODO(), input)
 	if err != nil {
 		return "", err
@@ -297,6 +303,18 @@ func deleteSnapshot(svc *ec2.Client, snapshotID string) error {
 	return err
 }
 
+// associateAddress moves the elastic ip of allocationID to an instance, taking it from the instance holding it
+func associateAddress(svc *ec2.Client, allocationID string, instanceID string) error {
+	input := &ec2.AssociateAddressInput{
+		AllocationId:       aws.String(allocationID),
+		InstanceId:         aws.String(instanceID),
+		AllowReassociation: aws.Bool(true),
+	}
+
+	_, err := svc.AssociateAddress(context.TODO(), input)
+	return err
+}
+
 // getInstanceDetailsFromString does what the name says
 func getInstanceDetailsFromString(svc *ec2.Client, instanceID string) (*types.Instance, error) {
 	input := &ec2.DescribeInstancesInput{
@@ -0,0 +1,220 @@
+package pcsdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/state"
+)
+
+// Batch collects create, modify and delete operations to be applied to a proxy as a whole
+type Batch struct {
+	proxy Proxy
+	ops   []command
+}
+
+// Result is the outcome of a single operation in a batch
+type Result struct {
+	Op  string
+	Id  state.CustomUUID
+	Err error
+}
+
+// Batch starts an empty batch of operations for the proxy
+func (p Proxy) Batch() *Batch {
+	return &Batch{proxy: p}
+}
+
+func (b *Batch) Create(iport uint16, oport uint16, oip netip.Addr, id state.CustomUUID) *Batch {
+	b.ops = append(b.ops, create(iport, oport, oip, id))
+	return b
+}
+
+func (b *Batch) Modify(oport uint16, oip netip.Addr, id state.CustomUUID) *Batch {
+	b.ops = append(b.ops, modify(oport, oip, id))
+	return b
+}
+
+// CreateTunnel adds the creation of a tunnel with all its settings
+func (b *Batch) CreateTunnel(id state.CustomUUID, t Tunnel) *Batch {
+	b.ops = append(b.ops, createTunnel(id, t))
+	return b
+}
+
+// ModifyTunnel adds setting all changeable settings of a tunnel
+func (b *Batch) ModifyTunnel(id state.CustomUUID, t Tunnel) *Batch {
+	b.ops = append(b.ops, modifyTunnel(id, t))
+	return b
+}
+
+func (b *Batch) Delete(id state.CustomUUID) *Batch {
+	b.ops = append(b.ops, deleteTunnel(id))
+	return b
+}
+
+// Len returns the number of operations in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Execute applies all operations atomically in one signed request if the proxy supports batches, otherwise one by one,
+// undoing the applied ones if any fails. The error is that of the first failed operation
+func (b *Batch) Execute(ctx context.Context) ([]Result, error) {
+	results := make([]Result, len(b.ops))
+	for i, op := range b.ops {
+		results[i].Op, results[i].Id = describe(op)
+	}
+	if len(b.ops) == 0 {
+		return results, nil
+	}
+
+	c, err := b.proxy.Capabilities(ctx)
+	if err != nil {
+		return results, err
+	}
+	if c.Supports(CapabilityBatch) {
+		return b.executeAtomic(ctx, results)
+	}
+	status, err := b.proxy.Status(ctx)
+	if err != nil {
+		return results, err
+	}
+	return b.executeSequential(ctx, status, results)
+}
+
+// executeAtomic sends all operations as one command, the proxy applies all or none of them
+func (b *Batch) executeAtomic(ctx context.Context, results []Result) ([]Result, error) {
+	c := command{Batch: b.ops}
+	body, err := b.proxy.execute(ctx, c, false)
+	var perr *ProxyError
+	if errors.As(err, &perr) && len(perr.Results) == len(results) {
+		for i := range results {
+			results[i].Err = perr.Results[i]
+		}
+		return results, err
+	}
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results, err
+	}
+
+	var r response
+	if len(body) > 0 && json.Unmarshal([]byte(body), &r) == nil && len(r.Results) == len(results) {
+		for i, res := range r.Results {
+			if res.Code != "" {
+				results[i].Err = res.err(0)
+			}
+		}
+	}
+	return results, nil
+}
+
+// executeSequential applies operations one by one, and on failure undoes the applied ones in reverse order
+func (b *Batch) executeSequential(ctx context.Context, status ProxyStatus, results []Result) ([]Result, error) {
+	tunnels := make(map[state.CustomUUID]Tunnel, len(status.Tunnels))
+	for id, t := range status.Tunnels {
+		tunnels[id] = t
+	}
+	undo := make([]*command, len(b.ops))
+
+	for i, op := range b.ops {
+		id := results[i].Id
+		before, existed := tunnels[id]
+		_, err := b.proxy.execute(ctx, op, op.Modify != nil)
+		if err == nil {
+			undo[i] = compensate(op, before, existed)
+			tunnels = apply(tunnels, op, id)
+			continue
+		}
+
+		results[i].Err = err
+		for j := i + 1; j < len(results); j++ {
+			results[j].Err = ErrAborted
+		}
+		for j := i - 1; j >= 0; j-- {
+			results[j].Err = ErrAborted
+			if undo[j] == nil {
+				continue
+			}
+			_, rerr := b.proxy.execute(ctx, *undo[j], undo[j].Modify != nil)
+			if rerr != nil {
+				results[j].Err = fmt.Errorf("%w: %s", ErrRollbackFailed, rerr)
+			}
+		}
+		return results, err
+	}
+	return results, nil
+}
+
+// compensate returns the operation undoing op, given the tunnel as it was before
+func compensate(op command, before Tunnel, existed bool) *command {
+	var c command
+	switch {
+	case op.Create != nil:
+		c = deleteTunnel(parseID(op.Create.Id))
+	case op.Modify != nil && existed:
+		c = modifyTunnel(parseID(op.Modify.Id), before)
+	case op.Delete != nil && existed:
+		c = restore(before, parseID(op.Delete.Id))
+	default:
+		return nil
+	}
+	return &c
+}
+
+// restore returns the create operation recreating a tunnel as reported by a proxy
+func restore(t Tunnel, id state.CustomUUID) command {
+	return createTunnel(id, t)
+}
+
+// apply updates a local copy of a tunnel table with a successful operation
+func apply(tunnels map[state.CustomUUID]Tunnel, op command, id state.CustomUUID) map[state.CustomUUID]Tunnel {
+	switch {
+	case op.Create != nil:
+		tunnels[id] = Tunnel{
+			IncomingPort:    op.Create.IncomingPort,
+			DestinationPort: op.Create.DestinationPort,
+			DestinationIP:   op.Create.DestinationIP,
+			Backends:        op.Create.Backends,
+			Protocol:        op.Create.Protocol,
+			AllowedSources:  op.Create.AllowedSources,
+			Limits:          op.Create.Limits,
+			ProxyProtocol:   op.Create.ProxyProtocol,
+		}
+	case op.Modify != nil:
+		t := tunnels[id]
+		t.DestinationPort = op.Modify.DestinationPort
+		t.DestinationIP = op.Modify.DestinationIP
+		t.Backends = op.Modify.Backends
+		t.AllowedSources = op.Modify.AllowedSources
+		t.Limits = op.Modify.Limits
+		t.ProxyProtocol = op.Modify.ProxyProtocol
+		tunnels[id] = t
+	case op.Delete != nil:
+		delete(tunnels, id)
+	}
+	return tunnels
+}
+
+// describe returns the name and tunnel id of an operation
+func describe(op command) (string, state.CustomUUID) {
+	switch {
+	case op.Create != nil:
+		return "create", parseID(op.Create.Id)
+	case op.Modify != nil:
+		return "modify", parseID(op.Modify.Id)
+	case op.Delete != nil:
+		return "delete", parseID(op.Delete.Id)
+	}
+	return "", state.CustomUUID{}
+}
+
+func parseID(id string) state.CustomUUID {
+	return state.CustomUUID(uuid.MustParse(id))
+}
@@ -0,0 +1,146 @@
+package pcsdk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Capabilities a proxy can advertise in its status
+const (
+	CapabilitySignatures  = "signatures"
+	CapabilityBatch       = "batch"
+	CapabilityUDP         = "udp"
+	CapabilityStats       = "stats"
+	CapabilityDrain       = "drain"
+	CapabilityWeighted    = "weighted"
+	CapabilityAllowlist   = "allowlist"
+	CapabilityLimits      = "limits"
+	CapabilityProxyProto  = "proxy_protocol"
+	CapabilityCertificate = "certificate"
+)
+
+// CapabilityTTL is how long the capabilities of a proxy are cached before asking again
+var CapabilityTTL = 10 * time.Minute
+
+// ErrUnsupported is returned before sending a command the proxy would not understand
+var ErrUnsupported = errors.New("unsupported by this proxy")
+
+// Capabilities is the version and feature set a proxy advertised during the handshake
+type Capabilities struct {
+	Version   string
+	Supported []string
+	fetched   time.Time
+}
+
+var (
+	capabilitiesMu sync.Mutex
+	capabilities   = make(map[netip.AddrPort]Capabilities)
+)
+
+// Supports returns if the proxy advertised capability
+func (c Capabilities) Supports(capability string) bool {
+	for _, s := range c.Supported {
+		if s == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns the version and capabilities of the proxy, asking it only if they are not cached
+func (p Proxy) Capabilities(ctx context.Context) (Capabilities, error) {
+	capabilitiesMu.Lock()
+	c, ok := capabilities[p.url]
+	capabilitiesMu.Unlock()
+	if ok && time.Since(c.fetched) < CapabilityTTL {
+		return c, nil
+	}
+
+	status, err := p.Status(ctx)
+	if err != nil {
+		return c, err
+	}
+	return status.capabilities(p.url), nil
+}
+
+// Require returns ErrUnsupported unless the proxy supports all of the capabilities
+func (p Proxy) Require(ctx context.Context, required ...string) error {
+	if len(required) == 0 {
+		return nil
+	}
+	c, err := p.Capabilities(ctx)
+	if err != nil {
+		return fmt.Errorf("could not negotiate capabilities: %w", err)
+	}
+	for _, r := range required {
+		if !c.Supports(r) {
+			return fmt.Errorf("%w: %s (proxy %s version %q)", ErrUnsupported, r, p.url, c.Version)
+		}
+	}
+	return nil
+}
+
+// ForgetCapabilities drops the cached capabilities of the proxy on addr, e.g. after it was upgraded or restarted
+func ForgetCapabilities(addr netip.AddrPort) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+	delete(capabilities, addr)
+}
+
+// capabilities caches and returns the capabilities advertised in a status
+func (s ProxyStatus) capabilities(addr netip.AddrPort) Capabilities {
+	c := Capabilities{Version: s.Version, Supported: s.Capabilities, fetched: time.Now()}
+	capabilitiesMu.Lock()
+	capabilities[addr] = c
+	capabilitiesMu.Unlock()
+	return c
+}
+
+// requires returns the capabilities a proxy needs to understand a command
+func (p Proxy) requires(c command) []string {
+	var required []string
+	if p.signing_key != "" {
+		required = append(required, CapabilitySignatures)
+	}
+	return append(required, features(c)...)
+}
+
+// features returns the optional features used by a command and the operations of a batch
+func features(c command) []string {
+	var required []string
+	if c.Batch != nil {
+		required = append(required, CapabilityBatch)
+	}
+	if c.Stats != nil {
+		required = append(required, CapabilityStats)
+	}
+	if c.Certificate != nil {
+		required = append(required, CapabilityCertificate)
+	}
+	for _, op := range c.Batch {
+		required = append(required, features(op)...)
+	}
+	if c.Modify != nil && c.Modify.DrainGrace > 0 {
+		required = append(required, CapabilityDrain)
+	}
+	if (c.Create != nil && len(c.Create.Backends) > 0) || (c.Modify != nil && len(c.Modify.Backends) > 0) {
+		required = append(required, CapabilityWeighted)
+	}
+	if (c.Create != nil && len(c.Create.AllowedSources) > 0) || (c.Modify != nil && len(c.Modify.AllowedSources) > 0) {
+		required = append(required, CapabilityAllowlist)
+	}
+	if (c.Create != nil && c.Create.limited()) || (c.Modify != nil && c.Modify.limited()) {
+		required = append(required, CapabilityLimits)
+	}
+	if (c.Create != nil && c.Create.ProxyProtocol > 0) || (c.Modify != nil && c.Modify.ProxyProtocol > 0) {
+		required = append(required, CapabilityProxyProto)
+	}
+	if c.Create != nil && c.Create.Protocol == ProtocolUDP {
+		required = append(required, CapabilityUDP)
+	}
+	return required
+}
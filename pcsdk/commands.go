@@ -1,79 +1,79 @@
 package pcsdk
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"net/netip"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/thefeli73/polemos/state"
 )
 
-type response struct {
-	message string `json:"message"`
+func (p Proxy) Create(ctx context.Context, iport uint16, oport uint16, oip netip.Addr, id state.CustomUUID) error {
+	_, err := p.execute(ctx, create(iport, oport, oip, id), false)
+	return err
 }
 
-type Proxy struct {
-	signing_key string
-	url 		netip.AddrPort
+func (p Proxy) Modify(ctx context.Context, oport uint16, oip netip.Addr, id state.CustomUUID) error {
+	_, err := p.execute(ctx, modify(oport, oip, id), true)
+	return err
 }
 
-func BuildProxy(control netip.AddrPort) Proxy {
-	return Proxy {"", control}
+func (p Proxy) Delete(ctx context.Context, id state.CustomUUID) error {
+	_, err := p.execute(ctx, deleteTunnel(id), false)
+	return err
 }
 
-func (p Proxy) Create(iport uint16, oport uint16, oip netip.Addr, id state.CustomUUID) error {
-	_, err := p.execute(create(iport, oport, oip, id))
+// CreateTunnel creates a tunnel with all its settings, e.g. weighted backends
+func (p Proxy) CreateTunnel(ctx context.Context, id state.CustomUUID, t Tunnel) error {
+	_, err := p.execute(ctx, createTunnel(id, t), false)
 	return err
 }
 
-func (p Proxy) Modify(oport uint16, oip netip.Addr, id state.CustomUUID) error {
-	_, err := p.execute(modify(oport, oip, id))
+// ModifyTunnel sets all changeable settings of a tunnel, e.g. shifting weight between backends
+func (p Proxy) ModifyTunnel(ctx context.Context, id state.CustomUUID, t Tunnel) error {
+	_, err := p.execute(ctx, modifyTunnel(id, t), true)
 	return err
 }
 
-func (p Proxy) Delete(id state.CustomUUID) error {
-	_, err := p.execute(delete(id))
+// InstallCertificate replaces the certificate the proxy serves, and authenticates to the hub with, by certPEM.
+// It has to be issued for the key the proxy already has, so the pin of the proxy stays valid
+func (p Proxy) InstallCertificate(ctx context.Context, certPEM []byte) error {
+	_, err := p.execute(ctx, certificate(certPEM), true)
 	return err
 }
 
-// TODO: status function returning map of tunnels
-
-func (p Proxy) execute(c command) (string, error) {
-	data, err := json.Marshal(c)
+// Status returns the version, uptime and live tunnel table of the proxy
+func (p Proxy) Status(ctx context.Context) (ProxyStatus, error) {
+	var s ProxyStatus
+	body, err := p.execute(ctx, status(), true)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("could not serialize: %s\n", err))
+		return s, err
 	}
-
-	requestURL := fmt.Sprintf("http://%s:%d/command", p.url.Addr().String(), p.url.Port())
-	fmt.Println(requestURL)
-	bodyReader := bytes.NewReader(data)
-
-	res, err := http.DefaultClient.Post(requestURL, "application/json", bodyReader)
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("error making http request: %s\n", err))
-	}
-	body, err := io.ReadAll(res.Body)
+	err = json.Unmarshal([]byte(body), &s)
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("error reading response: %s\n", err))
+		return s, fmt.Errorf("could not parse status: %w", err)
 	}
-
-	if res.StatusCode != 202 && res.StatusCode != 200 {
-		return "", errors.New(fmt.Sprintf("error processing command: (%d) %s\n", res.StatusCode, body))
-	} else {
-		return string(body), nil
+	if s.Tunnels == nil {
+		s.Tunnels = make(map[state.CustomUUID]Tunnel)
 	}
+	// every status refreshes the cached capabilities, so a proxy upgraded by a restart is renegotiated right away
+	s.capabilities(p.url)
+	return s, nil
 }
 
 type command struct {
 	Create *commandCreate `json:"create,omitempty"`
 	Modify *commandModify `json:"modify,omitempty"`
 	Delete *commandDelete `json:"delete,omitempty"`
+	Status *commandStatus `json:"status,omitempty"`
+	Stats  *commandStats  `json:"stats,omitempty"`
+	Certificate *commandCertificate `json:"certificate,omitempty"`
+	Batch  []command      `json:"batch,omitempty"`
 	Timestamp uint64	  `json:"timestamp,omitempty"`
+	Nonce     uint64	  `json:"nonce,omitempty"`
 	Signature string	  `json:"signature,omitempty"`
 }
 
@@ -82,35 +82,239 @@ type commandCreate struct {
 	DestinationPort uint16     `json:"destination_port"`
 	DestinationIP   netip.Addr `json:"destination_ip"`
 	Id              string     `json:"id"`
+	Backends        []Backend  `json:"backends,omitempty"`
+	Protocol        string     `json:"protocol,omitempty"`
+	AllowedSources  []netip.Prefix `json:"allowed_sources,omitempty"`
+	Limits
+	ProxyProtocol   uint8      `json:"proxy_protocol,omitempty"`
 }
 
 func create(iport uint16, oport uint16, oip netip.Addr, id state.CustomUUID) command {
-	cr:= commandCreate{iport, oport, oip, uuid.UUID.String(uuid.UUID(id))}
+	cr:= commandCreate{IncomingPort: iport, DestinationPort: oport, DestinationIP: oip, Id: uuid.UUID.String(uuid.UUID(id))}
 	c:= command{}
 	c.Create = &cr
 	return c
 }
 
+// createTunnel returns the create command for a tunnel with all its settings
+func createTunnel(id state.CustomUUID, t Tunnel) command {
+	c := create(t.IncomingPort, t.DestinationPort, t.DestinationIP, id)
+	c.Create.Backends = configured(t.Backends)
+	c.Create.Protocol = t.Protocol
+	c.Create.AllowedSources = t.AllowedSources
+	c.Create.Limits = t.Limits
+	c.Create.ProxyProtocol = t.ProxyProtocol
+	return c
+}
+
 type commandModify struct {
 	DestinationPort uint16     `json:"destination_port"`
 	DestinationIP   netip.Addr `json:"destination_ip"`
 	Id              string     `json:"id"`
+	// DrainGrace keeps existing connections on the old destination for up to this many seconds
+	DrainGrace      uint64     `json:"drain_grace,omitempty"`
+	Backends        []Backend  `json:"backends,omitempty"`
+	AllowedSources  []netip.Prefix `json:"allowed_sources,omitempty"`
+	Limits
+	ProxyProtocol   uint8      `json:"proxy_protocol,omitempty"`
 }
 
 func modify(oport uint16, oip netip.Addr, id state.CustomUUID) command {
-	m:= commandModify{oport, oip, uuid.UUID.String(uuid.UUID(id))}
+	m:= commandModify{DestinationPort: oport, DestinationIP: oip, Id: uuid.UUID.String(uuid.UUID(id))}
 	c:= command{}
 	c.Modify = &m
 	return c
 }
 
+// modifyTunnel returns the modify command setting all changeable settings of a tunnel
+func modifyTunnel(id state.CustomUUID, t Tunnel) command {
+	c := modify(t.DestinationPort, t.DestinationIP, id)
+	c.Modify.Backends = configured(t.Backends)
+	c.Modify.AllowedSources = t.AllowedSources
+	c.Modify.Limits = t.Limits
+	c.Modify.ProxyProtocol = t.ProxyProtocol
+	return c
+}
+
 type commandDelete struct {
 	Id string `json:"id"`
 }
 
-func delete(id state.CustomUUID) command {
+func deleteTunnel(id state.CustomUUID) command {
 	d:= commandDelete{uuid.UUID.String(uuid.UUID(id))}
 	c:= command{}
 	c.Delete = &d
 	return c
-}
\ No newline at end of file
+}
+
+type commandCertificate struct {
+	Cert string `json:"cert"`
+}
+
+func certificate(certPEM []byte) command {
+	c:= command{}
+	c.Certificate = &commandCertificate{string(certPEM)}
+	return c
+}
+
+type commandStatus struct {}
+
+func status() command {
+	c:= command{}
+	c.Status = &commandStatus{}
+	return c
+}
+
+// ProxyStatus is the state reported by a proxy: its version, uptime and tunnels by service UUID
+type ProxyStatus struct {
+	Version string                       `json:"version"`
+	Uptime  uint64                       `json:"uptime"`
+	Tunnels map[state.CustomUUID]Tunnel  `json:"tunnels"`
+	Capabilities []string                `json:"capabilities,omitempty"`
+	BootID  string                       `json:"boot_id,omitempty"`
+}
+
+// Supports returns if the proxy advertises capability
+func (s ProxyStatus) Supports(capability string) bool {
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Tunnel is a single forwarding rule as reported by a proxy
+type Tunnel struct {
+	IncomingPort    uint16     `json:"incoming_port"`
+	DestinationPort uint16     `json:"destination_port"`
+	DestinationIP   netip.Addr `json:"destination_ip"`
+	// Backends, if set, replace the destination and spread new connections by weight
+	Backends        []Backend  `json:"backends,omitempty"`
+	// Protocol is ProtocolTCP or ProtocolUDP, empty means TCP. It can only be set on create
+	Protocol        string     `json:"protocol,omitempty"`
+	// AllowedSources, if set, restrict the clients of the tunnel to these prefixes
+	AllowedSources  []netip.Prefix `json:"allowed_sources,omitempty"`
+	Limits
+	// ProxyProtocol is the PROXY protocol version prepended to connections to the destination, 0 sends none
+	ProxyProtocol   uint8      `json:"proxy_protocol,omitempty"`
+	// Draining is the number of connections still open to previous destinations
+	Draining        uint64     `json:"draining,omitempty"`
+	// Connections is the number of open connections, as reported by the proxy
+	Connections     uint64     `json:"connections,omitempty"`
+	// Rejected is the number of connections refused because of the limits, as reported by the proxy
+	Rejected        uint64     `json:"rejected,omitempty"`
+}
+
+// Limits cap the connections of a tunnel, 0 means unlimited
+type Limits struct {
+	MaxConnections uint32 `json:"max_connections,omitempty"`
+	// ConnectionRate is the number of new connections accepted per second
+	ConnectionRate uint32 `json:"connection_rate,omitempty"`
+}
+
+func (l Limits) limited() bool {
+	return l.MaxConnections > 0 || l.ConnectionRate > 0
+}
+
+// AtLimit returns if the tunnel has as many open connections as it allows
+func (t Tunnel) AtLimit() bool {
+	return t.MaxConnections > 0 && t.Connections >= uint64(t.MaxConnections)
+}
+
+// Usage describes the open connections of the tunnel against its limits
+func (t Tunnel) Usage() string {
+	max := "unlimited"
+	if t.MaxConnections > 0 {
+		max = fmt.Sprint(t.MaxConnections)
+	}
+	return fmt.Sprintf("%d/%s connections, %d rejected", t.Connections, max, t.Rejected)
+}
+
+// PROXY protocol versions a tunnel can prepend
+const (
+	ProxyProtocolV1 uint8 = 1
+	ProxyProtocolV2 uint8 = 2
+)
+
+// Protocols a tunnel can forward
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// Network returns the protocol the tunnel forwards, defaulting to ProtocolTCP
+func (t Tunnel) Network() string {
+	if t.Protocol == "" {
+		return ProtocolTCP
+	}
+	return t.Protocol
+}
+
+// Backend is one weighted destination of a tunnel
+type Backend struct {
+	IP       netip.Addr `json:"ip"`
+	Port     uint16     `json:"port"`
+	Weight   uint32     `json:"weight"`
+	// Failures is the number of connections to the backend that failed, as reported by the proxy
+	Failures uint64     `json:"failures,omitempty"`
+}
+
+// Matches returns if two tunnels forward the same way, ignoring what the proxy reports about their use
+func (t Tunnel) Matches(o Tunnel) bool {
+	if t.IncomingPort != o.IncomingPort ||
+		t.DestinationPort != o.DestinationPort ||
+		t.DestinationIP != o.DestinationIP ||
+		t.Network() != o.Network() ||
+		t.Limits != o.Limits ||
+		t.ProxyProtocol != o.ProxyProtocol ||
+		len(t.Backends) != len(o.Backends) ||
+		len(t.AllowedSources) != len(o.AllowedSources) {
+		return false
+	}
+	for i, prefix := range t.AllowedSources {
+		if prefix != o.AllowedSources[i] {
+			return false
+		}
+	}
+	for i, b := range t.Backends {
+		if b.IP != o.Backends[i].IP || b.Port != o.Backends[i].Port || b.Weight != o.Backends[i].Weight {
+			return false
+		}
+	}
+	return true
+}
+
+// ServiceTunnel returns the tunnel forwarding the entry port of a service to its backends
+func ServiceTunnel(service state.Service) Tunnel {
+	t := Tunnel{
+		IncomingPort:    service.EntryPort,
+		DestinationPort: service.ServicePort,
+		DestinationIP:   service.ServiceIP,
+		Protocol:        service.Protocol,
+		AllowedSources:  service.AllowedSources,
+		Limits:          Limits{MaxConnections: service.MaxConnections, ConnectionRate: service.ConnectionRate},
+		ProxyProtocol:   service.ProxyProtocol,
+	}
+	for _, b := range service.Backends {
+		t.Backends = append(t.Backends, Backend{IP: b.IP, Port: b.Port, Weight: b.Weight})
+	}
+	return t
+}
+
+// configured returns a copy of backends without what the proxy reports about their use
+func configured(backends []Backend) []Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	c := make([]Backend, len(backends))
+	for i, b := range backends {
+		c[i] = Backend{IP: b.IP, Port: b.Port, Weight: b.Weight}
+	}
+	return c
+}
+
+// UptimeDuration returns the proxy uptime (reported in seconds) as a duration
+func (s ProxyStatus) UptimeDuration() time.Duration {
+	return time.Duration(s.Uptime) * time.Second
+}
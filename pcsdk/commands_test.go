@@ -46,7 +46,7 @@ func TestCommandModifyJsonParse(t *testing.T) {
 func TestCommandDeleteJsonParse(t *testing.T) {
 	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
 	uuid := state.CustomUUID(id)
-	m := delete(uuid)
+	m := deleteTunnel(uuid)
 	msg, err := json.Marshal(m)
 	if err != nil {
 		t.Fatalf(`%q`, err)
@@ -58,3 +58,138 @@ func TestCommandDeleteJsonParse(t *testing.T) {
 			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
 	}
 }
+
+func TestCommandStatusJsonParse(t *testing.T) {
+	m := status()
+	msg, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := "{\"status\":{}}"
+	if string(msg) != expected {
+		t.Fatalf(
+			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
+	}
+}
+
+func TestProxyStatusJsonParse(t *testing.T) {
+	ip, _ := netip.ParseAddr("127.0.0.99")
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	body := "{\"version\":\"0.1.0\",\"uptime\":42,\"tunnels\":{\"87e79cbc-6df6-4462-8412-85d6c473e3b1\":{\"incoming_port\":5555,\"destination_port\":6666,\"destination_ip\":\"127.0.0.99\"}}}"
+	var s ProxyStatus
+	err := json.Unmarshal([]byte(body), &s)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := Tunnel{IncomingPort: 5555, DestinationPort: 6666, DestinationIP: ip}
+	if s.Version != "0.1.0" || s.Uptime != 42 {
+		t.Fatalf("\nGot:\t\t %+v\n", s)
+	}
+	if !s.Tunnels[state.CustomUUID(id)].Matches(expected) {
+		t.Fatalf(
+			"\nExpected:\t %+v\nGot:\t\t %+v\n", expected, s.Tunnels[state.CustomUUID(id)])
+	}
+}
+
+func TestCommandBatchJsonParse(t *testing.T) {
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	uuid := state.CustomUUID(id)
+	m := command{Batch: []command{deleteTunnel(uuid), deleteTunnel(uuid)}}
+	msg, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := "{\"batch\":[{\"delete\":{\"id\":\"87e79cbc-6df6-4462-8412-85d6c473e3b1\"}},{\"delete\":{\"id\":\"87e79cbc-6df6-4462-8412-85d6c473e3b1\"}}]}"
+	if string(msg) != expected {
+		t.Fatalf(
+			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
+	}
+}
+
+func TestCommandModifyDrainJsonParse(t *testing.T) {
+	ip, _ := netip.ParseAddr("127.0.0.99")
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	uuid := state.CustomUUID(id)
+	m := modify(8888, ip, uuid)
+	m.Modify.DrainGrace = 300
+	msg, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := "{\"modify\":{\"destination_port\":8888,\"destination_ip\":\"127.0.0.99\",\"id\":\"87e79cbc-6df6-4462-8412-85d6c473e3b1\",\"drain_grace\":300}}"
+	if string(msg) != expected {
+		t.Fatalf(
+			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
+	}
+}
+
+func TestCommandCreateBackendsJsonParse(t *testing.T) {
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	uuid := state.CustomUUID(id)
+	m := createTunnel(uuid, Tunnel{IncomingPort: 9999, DestinationPort: 8888, DestinationIP: netip.MustParseAddr("127.0.0.99"),
+		Backends: []Backend{{IP: netip.MustParseAddr("127.0.0.99"), Port: 8888, Weight: 90, Failures: 4},
+			{IP: netip.MustParseAddr("127.0.0.98"), Port: 8888, Weight: 10}}})
+	msg, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := "{\"create\":{\"incoming_port\":9999,\"destination_port\":8888,\"destination_ip\":\"127.0.0.99\",\"id\":\"87e79cbc-6df6-4462-8412-85d6c473e3b1\",\"backends\":[{\"ip\":\"127.0.0.99\",\"port\":8888,\"weight\":90},{\"ip\":\"127.0.0.98\",\"port\":8888,\"weight\":10}]}}"
+	if string(msg) != expected {
+		t.Fatalf(
+			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
+	}
+}
+
+func TestCommandCreateUDPJsonParse(t *testing.T) {
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	uuid := state.CustomUUID(id)
+	m := createTunnel(uuid, Tunnel{IncomingPort: 53, DestinationPort: 5353, DestinationIP: netip.MustParseAddr("127.0.0.99"), Protocol: ProtocolUDP})
+	msg, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := "{\"create\":{\"incoming_port\":53,\"destination_port\":5353,\"destination_ip\":\"127.0.0.99\",\"id\":\"87e79cbc-6df6-4462-8412-85d6c473e3b1\",\"protocol\":\"udp\"}}"
+	if string(msg) != expected {
+		t.Fatalf(
+			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
+	}
+}
+
+func TestCommandCreateLimitsJsonParse(t *testing.T) {
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	uuid := state.CustomUUID(id)
+	m := createTunnel(uuid, Tunnel{IncomingPort: 9999, DestinationPort: 8888, DestinationIP: netip.MustParseAddr("127.0.0.99"),
+		Limits: Limits{MaxConnections: 100, ConnectionRate: 10}, Connections: 5})
+	msg, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := "{\"create\":{\"incoming_port\":9999,\"destination_port\":8888,\"destination_ip\":\"127.0.0.99\",\"id\":\"87e79cbc-6df6-4462-8412-85d6c473e3b1\",\"max_connections\":100,\"connection_rate\":10}}"
+	if string(msg) != expected {
+		t.Fatalf(
+			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
+	}
+}
+
+func TestCommandModifyProxyProtocolJsonParse(t *testing.T) {
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	uuid := state.CustomUUID(id)
+	m := modifyTunnel(uuid, Tunnel{DestinationPort: 8888, DestinationIP: netip.MustParseAddr("127.0.0.99"), ProxyProtocol: ProxyProtocolV2})
+	msg, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	expected := "{\"modify\":{\"destination_port\":8888,\"destination_ip\":\"127.0.0.99\",\"id\":\"87e79cbc-6df6-4462-8412-85d6c473e3b1\",\"proxy_protocol\":2}}"
+	if string(msg) != expected {
+		t.Fatalf(
+			"\nExpected:\t %q\nGot:\t\t %q\n", expected, msg)
+	}
+}
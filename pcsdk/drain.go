@@ -0,0 +1,65 @@
+package pcsdk
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/thefeli73/polemos/state"
+)
+
+// DefaultDrainPoll is how often WaitDrained asks the proxy for open connections
+const DefaultDrainPoll = 2 * time.Second
+
+// ModifyDrain points new connections of a tunnel at a new destination, while existing ones stay on the old
+// destination until they close or grace has passed
+func (p Proxy) ModifyDrain(ctx context.Context, oport uint16, oip netip.Addr, id state.CustomUUID, grace time.Duration) error {
+	return p.ModifyTunnelDrain(ctx, id, Tunnel{DestinationPort: oport, DestinationIP: oip}, grace)
+}
+
+// ModifyTunnelDrain sets all changeable settings of a tunnel like ModifyTunnel, while existing connections stay on the
+// old destination until they close or grace has passed
+func (p Proxy) ModifyTunnelDrain(ctx context.Context, id state.CustomUUID, t Tunnel, grace time.Duration) error {
+	c := modifyTunnel(id, t)
+	c.Modify.DrainGrace = uint64(grace.Round(time.Second) / time.Second)
+	if c.Modify.DrainGrace == 0 {
+		c.Modify.DrainGrace = 1
+	}
+	_, err := p.execute(ctx, c, true)
+	return err
+}
+
+// WaitDrained polls the proxy until no connections of a tunnel are left on previous destinations, or grace has passed.
+// It returns the number of connections still open when it gave up
+func (p Proxy) WaitDrained(ctx context.Context, id state.CustomUUID, grace time.Duration, poll time.Duration) (uint64, error) {
+	if poll <= 0 {
+		poll = DefaultDrainPoll
+	}
+	deadline := time.Now().Add(grace)
+	for {
+		status, err := p.Status(ctx)
+		if err != nil {
+			return 0, err
+		}
+		tunnel, ok := status.Tunnels[id]
+		if !ok {
+			return 0, fmt.Errorf("%w: tunnel disappeared while draining", ErrTunnelNotFound)
+		}
+		if tunnel.Draining == 0 {
+			return 0, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return tunnel.Draining, nil
+		}
+		if poll < wait {
+			wait = poll
+		}
+		select {
+		case <-ctx.Done():
+			return tunnel.Draining, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package pcsdk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Errors reported by a proxy, match them with errors.Is
+var (
+	ErrTunnelNotFound = errors.New("tunnel not found")
+	ErrTunnelExists   = errors.New("tunnel already exists")
+	ErrPortInUse      = errors.New("port in use")
+	ErrUnauthorized   = errors.New("unauthorized")
+	ErrBadRequest     = errors.New("bad request")
+	ErrProxyInternal  = errors.New("proxy internal error")
+	ErrAborted        = errors.New("operation aborted with batch")
+	ErrRollbackFailed = errors.New("operation applied but could not be rolled back")
+)
+
+// response is the json body a proxy answers with when a command fails
+type response struct {
+	Code    string     `json:"code"`
+	Message string     `json:"message"`
+	Results []response `json:"results,omitempty"`
+}
+
+// err returns the error of a single operation result, nil if it succeeded
+func (r response) err(statusCode int) error {
+	if r.Code == "" {
+		return nil
+	}
+	e := &ProxyError{StatusCode: statusCode, Code: r.Code, Message: r.Message, Err: ErrBadRequest}
+	if err, ok := codes[r.Code]; ok {
+		e.Err = err
+	}
+	return e
+}
+
+// ProxyError is a failed command as reported by the proxy, match it with errors.As
+type ProxyError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Err        error
+	// Results holds the error of every operation of a failed batch, nil for those that would have succeeded
+	Results []error
+}
+
+func (e *ProxyError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("error processing command: (%d) %s", e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("error processing command: (%d) %s: %s", e.StatusCode, e.Err, e.Message)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// codes maps the error codes of the proxy to their sentinel errors
+var codes = map[string]error{
+	"tunnel_not_found": ErrTunnelNotFound,
+	"tunnel_exists":    ErrTunnelExists,
+	"port_in_use":      ErrPortInUse,
+	"unauthorized":     ErrUnauthorized,
+	"bad_request":      ErrBadRequest,
+	"internal":         ErrProxyInternal,
+	"aborted":          ErrAborted,
+}
+
+// parseError builds a ProxyError from a failed response, using the error code if present and the status code if not.
+// A 404 without error code is not a missing tunnel, e.g. a wrong endpoint, so it is a bad request
+func parseError(statusCode int, body []byte) *ProxyError {
+	e := &ProxyError{StatusCode: statusCode}
+	var r response
+	if json.Unmarshal(body, &r) == nil {
+		e.Code = r.Code
+		e.Message = r.Message
+		for _, res := range r.Results {
+			e.Results = append(e.Results, res.err(statusCode))
+		}
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	if err, ok := codes[e.Code]; ok {
+		e.Err = err
+		return e
+	}
+	switch {
+	case statusCode == http.StatusConflict:
+		e.Err = ErrTunnelExists
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		e.Err = ErrUnauthorized
+	case statusCode >= 500:
+		e.Err = ErrProxyInternal
+	default:
+		e.Err = ErrBadRequest
+	}
+	return e
+}
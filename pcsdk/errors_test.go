@@ -0,0 +1,69 @@
+package pcsdk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/state"
+)
+
+func TestParseErrorCode(t *testing.T) {
+	err := error(parseError(400, []byte("{\"code\":\"port_in_use\",\"message\":\"port 5555 is taken\"}")))
+	if !errors.Is(err, ErrPortInUse) {
+		t.Fatalf("expected ErrPortInUse, got %q", err)
+	}
+	var perr *ProxyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected ProxyError, got %T", err)
+	}
+	if perr.StatusCode != 400 || perr.Message != "port 5555 is taken" {
+		t.Fatalf("unexpected ProxyError %+v", perr)
+	}
+}
+
+func TestParseErrorStatusFallback(t *testing.T) {
+	cases := map[int]error{
+		http.StatusNotFound:            ErrBadRequest,
+		http.StatusConflict:            ErrTunnelExists,
+		http.StatusUnauthorized:        ErrUnauthorized,
+		http.StatusForbidden:           ErrUnauthorized,
+		http.StatusBadRequest:          ErrBadRequest,
+		http.StatusInternalServerError: ErrProxyInternal,
+	}
+	for code, expected := range cases {
+		err := parseError(code, []byte("not json"))
+		if !errors.Is(err, expected) {
+			t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", expected, err)
+		}
+		if err.Message != "not json" {
+			t.Fatalf("expected raw body as message, got %q", err.Message)
+		}
+	}
+}
+
+func TestStatusNotFoundIsNotTunnelNotFound(t *testing.T) {
+	proxy := testProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	_, err := proxy.Status(context.Background())
+	if errors.Is(err, ErrTunnelNotFound) {
+		t.Fatalf("expected 404 without error code not to be ErrTunnelNotFound, got %q", err)
+	}
+}
+
+func TestDeleteReturnsTypedError(t *testing.T) {
+	proxy := testProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("{\"code\":\"tunnel_not_found\",\"message\":\"no such tunnel\"}"))
+	})
+
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	err := proxy.Delete(context.Background(), state.CustomUUID(id))
+	if !errors.Is(err, ErrTunnelNotFound) {
+		t.Fatalf("expected ErrTunnelNotFound, got %q", err)
+	}
+}
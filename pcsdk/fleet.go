@@ -0,0 +1,207 @@
+package pcsdk
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thefeli73/polemos/state"
+)
+
+// ErrUnknownProxy is returned when targeting a proxy that is not part of the fleet
+var ErrUnknownProxy = errors.New("unknown proxy")
+
+// FleetProxy is a proxy of the fleet and what was learned from its last status check
+type FleetProxy struct {
+	Addr    netip.Addr
+	Proxy   Proxy
+	Healthy bool
+	// Failures is the number of status checks that failed in a row
+	Failures int
+	// LastSeen is when the proxy last answered a status check
+	LastSeen  time.Time
+	LastError error
+	// Status is the last status the proxy answered with, including its tunnels
+	Status  ProxyStatus
+	// Restarted is set if the proxy restarted since the previous status check, and has likely lost its tunnels
+	Restarted bool
+	checked bool
+}
+
+// ProxyFleet tracks every proxy in the config: its health, tunnels and when it was last seen
+type ProxyFleet struct {
+	mu       sync.Mutex
+	proxies  map[netip.Addr]*FleetProxy
+	restarts *RestartTracker
+}
+
+// NewFleet returns a fleet of every proxy in config, none of them checked yet
+func NewFleet(config state.Config) *ProxyFleet {
+	f := &ProxyFleet{proxies: make(map[netip.Addr]*FleetProxy), restarts: NewRestartTracker()}
+	f.Update(config)
+	return f
+}
+
+// Update adds the proxies new to config, drops those no longer in it and applies changed settings to all others
+func (f *ProxyFleet) Update(config state.Config) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	known := make(map[netip.Addr]*FleetProxy, len(f.proxies))
+	for _, addr := range config.ProxyAddrs() {
+		fp, ok := f.proxies[addr]
+		if !ok {
+			fp = &FleetProxy{Addr: addr}
+		}
+		fp.Proxy = ProxyFromConfig(config, addr)
+		known[addr] = fp
+	}
+	f.proxies = known
+}
+
+// Refresh checks the status of every proxy concurrently and returns the proxies whose health changed
+func (f *ProxyFleet) Refresh(ctx context.Context) []FleetProxy {
+	f.mu.Lock()
+	targets := make(map[netip.Addr]Proxy, len(f.proxies))
+	for addr, fp := range f.proxies {
+		targets[addr] = fp.Proxy
+	}
+	f.mu.Unlock()
+
+	type result struct {
+		status ProxyStatus
+		err    error
+	}
+	results := make(map[netip.Addr]result, len(targets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for addr, proxy := range targets {
+		wg.Add(1)
+		go func(addr netip.Addr, proxy Proxy) {
+			defer wg.Done()
+			status, err := proxy.Status(ctx)
+			mu.Lock()
+			results[addr] = result{status, err}
+			mu.Unlock()
+		}(addr, proxy)
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var changed []FleetProxy
+	for addr, res := range results {
+		fp, ok := f.proxies[addr]
+		if !ok {
+			// dropped by an update while checking
+			continue
+		}
+		healthy := res.err == nil
+		fp.Restarted = false
+		if res.err == nil {
+			fp.Restarted = f.restarts.Observe(fp.Proxy.Addr(), res.status)
+			fp.Status = res.status
+			fp.LastSeen = time.Now()
+			fp.LastError = nil
+			fp.Failures = 0
+		} else {
+			fp.LastError = res.err
+			fp.Failures++
+		}
+		if fp.checked && fp.Healthy != healthy {
+			changed = append(changed, *fp)
+			changed[len(changed)-1].Healthy = healthy
+		}
+		fp.Healthy = healthy
+		fp.checked = true
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Addr.Less(changed[j].Addr) })
+	return changed
+}
+
+// Proxies returns a copy of every proxy of the fleet, sorted by address
+func (f *ProxyFleet) Proxies() []FleetProxy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	proxies := make([]FleetProxy, 0, len(f.proxies))
+	for _, fp := range f.proxies {
+		proxies = append(proxies, *fp)
+	}
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].Addr.Less(proxies[j].Addr) })
+	return proxies
+}
+
+// Get returns a copy of the proxy on addr
+func (f *ProxyFleet) Get(addr netip.Addr) (FleetProxy, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fp, ok := f.proxies[addr]
+	if !ok {
+		return FleetProxy{}, false
+	}
+	return *fp, true
+}
+
+// Healthy returns the addresses of the proxies that answered their last status check, sorted
+func (f *ProxyFleet) Healthy() []netip.Addr {
+	var healthy []netip.Addr
+	for _, fp := range f.Proxies() {
+		if fp.Healthy {
+			healthy = append(healthy, fp.Addr)
+		}
+	}
+	return healthy
+}
+
+// Replaced forgets the restarts seen from the proxy on addr, as it was replaced on purpose, e.g. moved to a new
+// instance keeping its entry
+func (f *ProxyFleet) Replaced(addr netip.Addr) {
+	fp, ok := f.Get(addr)
+	if !ok {
+		return
+	}
+	f.restarts.Forget(fp.Proxy.Addr())
+}
+
+// Restarted returns the addresses of the proxies that restarted since the check before their last one, sorted
+func (f *ProxyFleet) Restarted() []netip.Addr {
+	var restarted []netip.Addr
+	for _, fp := range f.Proxies() {
+		if fp.Restarted {
+			restarted = append(restarted, fp.Addr)
+		}
+	}
+	return restarted
+}
+
+// Target runs command against the proxy on addr
+func (f *ProxyFleet) Target(ctx context.Context, addr netip.Addr, command func(context.Context, Proxy) error) error {
+	fp, ok := f.Get(addr)
+	if !ok {
+		return ErrUnknownProxy
+	}
+	return command(ctx, fp.Proxy)
+}
+
+// Broadcast runs command against every proxy of the fleet concurrently and returns the errors by proxy
+func (f *ProxyFleet) Broadcast(ctx context.Context, command func(context.Context, Proxy) error) map[netip.Addr]error {
+	errs := make(map[netip.Addr]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, fp := range f.Proxies() {
+		wg.Add(1)
+		go func(fp FleetProxy) {
+			defer wg.Done()
+			err := command(ctx, fp.Proxy)
+			if err != nil {
+				mu.Lock()
+				errs[fp.Addr] = err
+				mu.Unlock()
+			}
+		}(fp)
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,422 @@
+package pcsdk
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/thefeli73/polemos/state"
+)
+
+// DefaultWait is how long a poll is held open while no command is pending when none is configured
+const DefaultWait = 30 * time.Second
+
+// ErrNotConnected is returned when relaying a command to a proxy that is not polling the hub
+var ErrNotConnected = errors.New("proxy not connected to hub")
+
+// DefaultHub relays the commands of every proxy configured to pull them, it is nil while the hub is disabled
+var DefaultHub *Hub
+
+// HubRequest is what a proxy sends to the hub, signed like a command or sent with its client certificate.
+// The nonce has to be higher than the one of the last request of the proxy, so requests can not be replayed.
+// Results carry the id of the command and the status code and body the proxy would have answered it with
+type HubRequest struct {
+	EntryIP    netip.Addr `json:"entry_ip"`
+	Nonce      uint64     `json:"nonce,omitempty"`
+	Id         uint64     `json:"id,omitempty"`
+	StatusCode int        `json:"status_code,omitempty"`
+	Body       string     `json:"body,omitempty"`
+	Timestamp  uint64     `json:"timestamp,omitempty"`
+	Signature  string     `json:"signature,omitempty"`
+}
+
+// HubCommand is a command relayed to a polling proxy, it handles it as if it was posted to /command
+type HubCommand struct {
+	Id      uint64          `json:"id"`
+	Command json.RawMessage `json:"command"`
+}
+
+// HubWelcome is the answer to a registration
+type HubWelcome struct {
+	// Wait is the seconds a poll is held open while no command is pending
+	Wait uint64 `json:"wait"`
+}
+
+// Hub relays commands to proxies that register and poll for them, e.g. because they are behind NAT.
+// The commands are signed as usual, the hub only authenticates which proxy is polling.
+// Only proxies configured to pull are accepted, by their own signing key or their client certificate
+type Hub struct {
+	mu       sync.Mutex
+	registry *state.Registry
+	keys     map[netip.Addr]string
+	guards   map[netip.Addr]*ReplayGuard
+	skew     time.Duration
+	wait     time.Duration
+	next     uint64
+	proxies  map[netip.Addr]*pulling
+}
+
+// pulling is a registered proxy and the commands waiting for it
+type pulling struct {
+	commands chan *relayed
+	inflight map[uint64]*relayed
+	polls    int
+	lastPoll time.Time
+}
+
+// take removes a command from the inflight ones and returns it, nil if it is not inflight
+func (p *pulling) take(id uint64) *relayed {
+	c, ok := p.inflight[id]
+	if !ok {
+		return nil
+	}
+	delete(p.inflight, id)
+	return c
+}
+
+type relayed struct {
+	id   uint64
+	ctx  context.Context
+	data []byte
+	done chan relayResult
+}
+
+type relayResult struct {
+	statusCode int
+	body       []byte
+}
+
+// NewHub returns a hub recording registrations in registry
+func NewHub(registry *state.Registry) *Hub {
+	if registry == nil {
+		registry = state.NewRegistry()
+	}
+	return &Hub{registry: registry, keys: make(map[netip.Addr]string),
+		guards: make(map[netip.Addr]*ReplayGuard), wait: DefaultWait, proxies: make(map[netip.Addr]*pulling)}
+}
+
+// StartHub serves DefaultHub on the configured address over https, it does nothing if the hub is disabled.
+// Commands carry the addresses of the services, so the hub never serves them in plaintext
+func StartHub(config state.Config) error {
+	if config.MTD.Hub.Listen == "" {
+		return nil
+	}
+	if config.MTD.Hub.CertPath == "" {
+		return errors.New("hub requires a cert_path, commands are never relayed in plaintext")
+	}
+	tlsConfig, err := hubTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	registry, err := state.OpenRegistry(config.MTD.Hub.RegistryPath)
+	if err != nil {
+		return err
+	}
+	h := NewHub(registry)
+	h.Update(config)
+	server := &http.Server{Addr: config.MTD.Hub.Listen, Handler: h, TLSConfig: tlsConfig}
+	DefaultHub = h
+	go func() {
+		err := server.ListenAndServeTLS("", "")
+		fmt.Println("Error serving hub:\t", err)
+	}()
+	fmt.Printf("Hub listening on %s, %d proxies registered\n", config.MTD.Hub.Listen, len(registry.Entries()))
+	return nil
+}
+
+// hubTLSConfig loads the hub certificate, proxies may authenticate with a certificate of the tls ca
+func hubTLSConfig(config state.Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.MTD.Hub.CertPath, config.MTD.Hub.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load hub certificate: %w", err)
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if config.MTD.TLS.CAPath != "" {
+		caPEM, err := ioutil.ReadFile(config.MTD.TLS.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no certificates found in ca")
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return c, nil
+}
+
+// Update applies the proxies configured to pull, their signing keys and the settings of config.
+// The global signing key is never accepted, a proxy without a key of its own has to authenticate by certificate
+func (h *Hub) Update(config state.Config) {
+	if h == nil {
+		return
+	}
+	keys := make(map[netip.Addr]string)
+	for entry, proxy := range config.MTD.Proxies {
+		if proxy.Pull {
+			keys[entry] = proxy.SigningKey
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.keys = keys
+	h.skew = time.Duration(config.MTD.SignatureSkew) * time.Second
+	h.wait = DefaultWait
+	if config.MTD.Hub.Wait > 0 {
+		h.wait = time.Duration(config.MTD.Hub.Wait) * time.Second
+	}
+}
+
+// Registry returns the registry of the hub
+func (h *Hub) Registry() *state.Registry {
+	if h == nil {
+		return nil
+	}
+	return h.registry
+}
+
+// Connected returns if the proxy on entry is polling or polled recently enough to pick up a command
+func (h *Hub) Connected(entry netip.Addr) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.proxies[entry]
+	return ok && h.connected(p)
+}
+
+func (h *Hub) connected(p *pulling) bool {
+	// a proxy polls again right after every answer, allow for one missed poll
+	return p.polls > 0 || time.Since(p.lastPoll) < 2*h.wait
+}
+
+// Send relays a serialized command to the proxy on entry and returns the status code and body it answered with
+func (h *Hub) Send(ctx context.Context, entry netip.Addr, data []byte) (int, []byte, error) {
+	if h == nil {
+		return 0, nil, fmt.Errorf("hub is not running: %w", ErrNotConnected)
+	}
+	h.mu.Lock()
+	p, ok := h.proxies[entry]
+	if !ok || !h.connected(p) {
+		h.mu.Unlock()
+		return 0, nil, ErrNotConnected
+	}
+	h.next++
+	r := &relayed{id: h.next, ctx: ctx, data: data, done: make(chan relayResult, 1)}
+	commands := p.commands
+	h.mu.Unlock()
+
+	select {
+	case commands <- r:
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+	select {
+	case res := <-r.done:
+		return res.statusCode, res.body, nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		p.take(r.id)
+		h.mu.Unlock()
+		return 0, nil, ctx.Err()
+	}
+}
+
+// ServeHTTP serves /register, /poll and /result to proxies, only over https
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		http.Error(w, "hub only serves https", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "could not read request", http.StatusBadRequest)
+		return
+	}
+	req, err := h.authenticate(r, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/register":
+		h.register(w, r, req)
+	case "/poll":
+		h.poll(w, r, req)
+	case "/result":
+		h.result(w, req)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authenticate parses a request and checks it was sent by a proxy configured to pull as the one it claims to be,
+// by its verified client certificate for the entry ip or by its own signing key, and that it is not replayed
+func (h *Hub) authenticate(r *http.Request, data []byte) (HubRequest, error) {
+	var req HubRequest
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return req, fmt.Errorf("could not parse request: %w", err)
+	}
+	if !req.EntryIP.IsValid() {
+		return req, errors.New("request has no entry ip")
+	}
+	h.mu.Lock()
+	key, ok := h.keys[req.EntryIP]
+	skew := h.skew
+	guard := h.guards[req.EntryIP]
+	if ok && guard == nil {
+		guard = &ReplayGuard{}
+		h.guards[req.EntryIP] = guard
+	}
+	h.mu.Unlock()
+	if !ok {
+		return req, fmt.Errorf("%w: %s is not configured to pull", ErrUnauthorized, req.EntryIP)
+	}
+
+	if !certifies(r, req.EntryIP) {
+		if key == "" {
+			return req, ErrUnauthorized
+		}
+		err = VerifyCommand(data, key, skew, time.Now())
+		if err != nil {
+			return req, fmt.Errorf("%w: %s", ErrUnauthorized, err)
+		}
+	}
+	err = guard.Check(data)
+	if err != nil {
+		return req, fmt.Errorf("%w: %s", ErrUnauthorized, err)
+	}
+	return req, nil
+}
+
+// certifies returns if the request was sent with a verified client certificate for entry
+func certifies(r *http.Request, entry netip.Addr) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	for _, ip := range r.TLS.VerifiedChains[0][0].IPAddresses {
+		if addr, ok := netip.AddrFromSlice(ip); ok && addr.Unmap() == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// proxy returns the proxy on entry, adding it if it is new
+func (h *Hub) proxy(entry netip.Addr) *pulling {
+	p, ok := h.proxies[entry]
+	if !ok {
+		p = &pulling{commands: make(chan *relayed, 64), inflight: make(map[uint64]*relayed)}
+		h.proxies[entry] = p
+	}
+	return p
+}
+
+func (h *Hub) register(w http.ResponseWriter, r *http.Request, req HubRequest) {
+	err := h.registry.Register(req.EntryIP, r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "could not register", http.StatusInternalServerError)
+		return
+	}
+	h.mu.Lock()
+	h.proxy(req.EntryIP).lastPoll = time.Now()
+	wait := h.wait
+	h.mu.Unlock()
+	fmt.Printf("Proxy %s registered from %s\n", req.EntryIP, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HubWelcome{Wait: uint64(wait / time.Second)})
+}
+
+// poll answers with the next command for the proxy, or no content if none is sent while waiting
+func (h *Hub) poll(w http.ResponseWriter, r *http.Request, req HubRequest) {
+	if !h.registry.Seen(req.EntryIP) {
+		http.Error(w, "not registered", http.StatusNotFound)
+		return
+	}
+	h.mu.Lock()
+	p := h.proxy(req.EntryIP)
+	p.polls++
+	wait := h.wait
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		p.polls--
+		p.lastPoll = time.Now()
+		h.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case c := <-p.commands:
+			if c.ctx.Err() != nil {
+				// the sender gave up on it already
+				continue
+			}
+			h.mu.Lock()
+			p.inflight[c.id] = c
+			h.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(HubCommand{Id: c.id, Command: c.data})
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *Hub) result(w http.ResponseWriter, req HubRequest) {
+	h.mu.Lock()
+	var c *relayed
+	if p, ok := h.proxies[req.EntryIP]; ok {
+		c = p.take(req.Id)
+	}
+	h.mu.Unlock()
+	if c == nil {
+		http.Error(w, "unknown command", http.StatusNotFound)
+		return
+	}
+	c.done <- relayResult{statusCode: req.StatusCode, body: []byte(req.Body)}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SignHubRequest serializes a request to the hub, signed with key unless it is empty, as a proxy would.
+// The nonce of req is kept, it has to be set by the caller
+func SignHubRequest(req HubRequest, key string, now time.Time) ([]byte, error) {
+	req.Signature = ""
+	req.Timestamp = 0
+	if key == "" {
+		return json.Marshal(req)
+	}
+	req.Timestamp = uint64(now.Unix())
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	req.Signature, err = signature(data, key)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(req)
+}
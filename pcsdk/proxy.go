@@ -0,0 +1,255 @@
+package pcsdk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/thefeli73/polemos/state"
+)
+
+// DefaultTimeout is the time a single request to a proxy may take when none is configured
+const DefaultTimeout = 10 * time.Second
+
+// DefaultBackoff is the wait before the first retry of an idempotent command, doubling on every retry
+const DefaultBackoff = 500 * time.Millisecond
+
+type Proxy struct {
+	signing_key string
+	url         netip.AddrPort
+	skew        time.Duration
+	nonces      *state.Nonces
+	client      *http.Client
+	timeout     time.Duration
+	retries     int
+	backoff     time.Duration
+	scheme      string
+	hub         *Hub
+	err         error
+}
+
+func BuildProxy(control netip.AddrPort) Proxy {
+	return Proxy{
+		url:     control,
+		skew:    DefaultSkew,
+		client:  http.DefaultClient,
+		timeout: DefaultTimeout,
+		backoff: DefaultBackoff,
+		scheme:  "http",
+	}
+}
+
+// BuildSignedProxy returns a proxy whose commands are timestamped and signed with key, and numbered from nonces if not nil
+func BuildSignedProxy(control netip.AddrPort, key string, skew time.Duration, nonces *state.Nonces) Proxy {
+	p := BuildProxy(control)
+	if skew > 0 {
+		p.skew = skew
+	}
+	p.signing_key = key
+	p.nonces = nonces
+	return p
+}
+
+// ProxyFromConfig builds the proxy listening on the management port of entry, signed if a key is configured
+func ProxyFromConfig(config state.Config, entry netip.Addr) Proxy {
+	control := config.ManagementAddr(entry)
+	var p Proxy
+	key := config.SigningKey(entry)
+	if key == "" {
+		p = BuildProxy(control)
+	} else {
+		var nonces *state.Nonces
+		var nonceErr error
+		if config.MTD.NoncePath != "" {
+			nonces, nonceErr = state.OpenNonces(config.MTD.NoncePath)
+		}
+		p = BuildSignedProxy(control, key, time.Duration(config.MTD.SignatureSkew)*time.Second, nonces)
+		if nonceErr != nil {
+			// commands without nonce are rejected by proxies checking replays, fail with the cause instead
+			p.err = fmt.Errorf("could not open nonces: %w", nonceErr)
+		}
+	}
+	if config.MTD.TLS.CertPath != "" {
+		client, err := tlsClient(config.MTD.TLS.CAPath, config.MTD.TLS.CertPath, config.MTD.TLS.KeyPath, config.MTD.Proxies[entry].Pin)
+		if err != nil {
+			// never fall back to plaintext, every command fails with this error instead
+			p.err = fmt.Errorf("could not configure tls: %w", err)
+		}
+		p.client = client
+		p.scheme = "https"
+	}
+	if config.MTD.Proxies[entry].Pull {
+		// the proxy cannot be reached, it polls the hub for its commands
+		p = p.WithHub(DefaultHub)
+	}
+	if config.MTD.CommandTimeout > 0 {
+		p = p.WithTimeout(time.Duration(config.MTD.CommandTimeout) * time.Second)
+	}
+	return p.WithRetries(config.MTD.CommandRetries, p.backoff)
+}
+
+// WithClient returns a copy of the proxy sending its requests through client
+func (p Proxy) WithClient(client *http.Client) Proxy {
+	p.client = client
+	return p
+}
+
+// WithTimeout returns a copy of the proxy where every single request is limited to timeout
+func (p Proxy) WithTimeout(timeout time.Duration) Proxy {
+	p.timeout = timeout
+	return p
+}
+
+// WithRetries returns a copy of the proxy retrying idempotent commands up to retries times, waiting backoff (doubling) in between
+func (p Proxy) WithRetries(retries int, backoff time.Duration) Proxy {
+	p.retries = retries
+	p.backoff = backoff
+	return p
+}
+
+// WithHub returns a copy of the proxy relaying its commands through hub, for proxies that poll for them
+func (p Proxy) WithHub(hub *Hub) Proxy {
+	p.hub = hub
+	if hub == nil {
+		p.err = fmt.Errorf("hub is not running: %w", ErrNotConnected)
+	}
+	return p
+}
+
+// WithAddr returns a copy of the proxy sending its commands to addr instead, e.g. a replacement not yet on its entry
+func (p Proxy) WithAddr(addr netip.AddrPort) Proxy {
+	p.url = addr
+	return p
+}
+
+// Addr returns the management address of the proxy
+func (p Proxy) Addr() netip.AddrPort {
+	return p.url
+}
+
+// Verify checks a serialized command against the signing key and skew window of the proxy
+func (p Proxy) Verify(data []byte) error {
+	return VerifyCommand(data, p.signing_key, p.skew, time.Now())
+}
+
+// execute sends a command to the proxy, retrying with backoff on transport and server errors if idempotent
+func (p Proxy) execute(ctx context.Context, c command, idempotent bool) (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	if c.Status == nil {
+		err := p.Require(ctx, p.requires(c)...)
+		if err != nil {
+			return "", err
+		}
+	}
+	attempts := 1
+	if idempotent && p.retries > 0 {
+		attempts += p.retries
+	}
+	backoff := p.backoff
+
+	var err error
+	var body string
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		var retry bool
+		body, retry, err = p.send(ctx, c)
+		if errors.Is(err, ErrBadRequest) {
+			// the proxy may have been replaced by an older version since the handshake
+			ForgetCapabilities(p.url)
+		}
+		if err == nil || !retry {
+			break
+		}
+	}
+	return body, err
+}
+
+// send signs and posts a single command, reporting whether a failure is worth retrying
+func (p Proxy) send(ctx context.Context, c command) (string, bool, error) {
+	if p.signing_key != "" {
+		var err error
+		if p.nonces != nil {
+			c.Nonce, err = p.nonces.Next(p.url.String())
+			if err != nil {
+				return "", false, fmt.Errorf("could not reserve nonce: %w", err)
+			}
+		}
+		c, err = sign(c, p.signing_key, time.Now())
+		if err != nil {
+			return "", false, fmt.Errorf("could not sign: %w", err)
+		}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", false, fmt.Errorf("could not serialize: %w", err)
+	}
+
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	var statusCode int
+	var body []byte
+	if p.hub != nil {
+		statusCode, body, err = p.hub.Send(ctx, p.url.Addr(), data)
+		if err != nil {
+			return "", true, fmt.Errorf("error relaying command: %w", err)
+		}
+	} else {
+		var retry bool
+		statusCode, body, retry, err = p.post(ctx, data)
+		if err != nil {
+			return "", retry, err
+		}
+	}
+
+	if statusCode != 202 && statusCode != 200 {
+		return "", statusCode >= 500, parseError(statusCode, body)
+	} else {
+		return string(body), false, nil
+	}
+}
+
+// post sends a serialized command to the management port of the proxy
+func (p Proxy) post(ctx context.Context, data []byte) (int, []byte, bool, error) {
+	requestURL := fmt.Sprintf("%s://%s/command", p.scheme, p.url.String())
+	bodyReader := bytes.NewReader(data)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, requestURL, bodyReader)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("error building http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := p.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, nil, true, fmt.Errorf("error making http request: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, true, fmt.Errorf("error reading response: %w", err)
+	}
+	return res.StatusCode, body, false, nil
+}
@@ -0,0 +1,113 @@
+package pcsdk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/state"
+)
+
+func testProxy(t *testing.T, handler http.HandlerFunc) Proxy {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	control := netip.MustParseAddrPort(server.Listener.Addr().String())
+	return BuildProxy(control).WithClient(server.Client())
+}
+
+func TestStatusRetriesServerErrors(t *testing.T) {
+	var calls int32
+	proxy := testProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("{\"version\":\"0.1.0\",\"uptime\":1,\"tunnels\":{}}"))
+	}).WithRetries(2, time.Millisecond)
+
+	s, err := proxy.Status(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if s.Version != "0.1.0" || calls != 3 {
+		t.Fatalf("expected 3 calls and a status, got %d calls and %+v", calls, s)
+	}
+}
+
+func TestCreateDoesNotRetry(t *testing.T) {
+	var calls int32
+	proxy := testProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}).WithRetries(2, time.Millisecond)
+
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	err := proxy.Create(context.Background(), 5555, 6666, netip.MustParseAddr("127.0.0.99"), state.CustomUUID(id))
+	if err == nil {
+		t.Fatalf("expected create to fail")
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	proxy := testProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+	}).WithTimeout(20 * time.Millisecond)
+
+	t0 := time.Now()
+	_, err := proxy.Status(context.Background())
+	if err == nil {
+		t.Fatalf("expected status to time out")
+	}
+	if time.Since(t0) > 500*time.Millisecond {
+		t.Fatalf("timeout not honoured, took %s", time.Since(t0))
+	}
+}
+
+func TestContextCancelStopsRetries(t *testing.T) {
+	var calls int32
+	proxy := testProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}).WithRetries(5, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := proxy.Status(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestProxyFromConfigFailsWithoutNonces(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "nonces.yaml")
+	err := os.WriteFile(filename, []byte("not: [valid"), 0600)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	var config state.Config
+	config.MTD.SigningKey = "secret"
+	config.MTD.NoncePath = filename
+	config.MTD.ManagementPort = 14000
+
+	_, err = ProxyFromConfig(config, netip.MustParseAddr("127.0.0.1")).Status(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "could not open nonces") {
+		t.Fatalf("expected nonce error, got %q", err)
+	}
+}
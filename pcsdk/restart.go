@@ -0,0 +1,48 @@
+package pcsdk
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// observation is the last status seen from a proxy
+type observation struct {
+	bootID string
+	uptime uint64
+}
+
+// RestartTracker remembers the last status a consumer saw from every proxy, so each consumer (e.g. the reconciler
+// and the fleet) learns about every restart on its own no matter who asked for a status first
+type RestartTracker struct {
+	mu       sync.Mutex
+	observed map[netip.AddrPort]observation
+}
+
+// NewRestartTracker returns a tracker that has not seen any proxy yet
+func NewRestartTracker() *RestartTracker {
+	return &RestartTracker{observed: make(map[netip.AddrPort]observation)}
+}
+
+// Observe records a status of the proxy on addr and returns if it restarted since the previous one,
+// i.e. its boot id changed or its uptime went backwards
+func (r *RestartTracker) Observe(addr netip.AddrPort, s ProxyStatus) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last, ok := r.observed[addr]
+	r.observed[addr] = observation{s.BootID, s.Uptime}
+	if !ok {
+		return false
+	}
+	if last.bootID != "" && s.BootID != "" {
+		return last.bootID != s.BootID
+	}
+	return s.Uptime < last.uptime
+}
+
+// Forget drops what was seen from the proxy on addr, e.g. because it was replaced on purpose, so its next status is
+// not taken for a restart
+func (r *RestartTracker) Forget(addr netip.AddrPort) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.observed, addr)
+}
@@ -0,0 +1,105 @@
+package pcsdk
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/state"
+)
+
+func signedModify(t *testing.T, key string, now time.Time) []byte {
+	ip, _ := netip.ParseAddr("127.0.0.99")
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+	c, err := sign(modify(8888, ip, state.CustomUUID(id)), key, now)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	msg, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	return msg
+}
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+	msg := signedModify(t, "secret", now)
+
+	err := VerifyCommand(msg, "secret", DefaultSkew, now.Add(10*time.Second))
+	if err != nil {
+		t.Fatalf("expected valid signature, got %q", err)
+	}
+}
+
+func TestVerifyRejectsWrongKey(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+	msg := signedModify(t, "secret", now)
+
+	err := VerifyCommand(msg, "other", DefaultSkew, now)
+	if err == nil {
+		t.Fatalf("expected wrong key to be rejected")
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+	msg := signedModify(t, "secret", now)
+	tampered := strings.Replace(string(msg), "127.0.0.99", "127.0.0.66", 1)
+
+	err := VerifyCommand([]byte(tampered), "secret", DefaultSkew, now)
+	if err == nil {
+		t.Fatalf("expected tampered command to be rejected")
+	}
+}
+
+func TestVerifyRejectsSkew(t *testing.T) {
+	now := time.Unix(1680000000, 0)
+	msg := signedModify(t, "secret", now)
+
+	err := VerifyCommand(msg, "secret", 5*time.Second, now.Add(time.Minute))
+	if err == nil {
+		t.Fatalf("expected stale command to be rejected")
+	}
+	err = VerifyCommand(msg, "secret", 5*time.Second, now.Add(-time.Minute))
+	if err == nil {
+		t.Fatalf("expected future command to be rejected")
+	}
+}
+
+func TestReplayGuardRejectsDuplicates(t *testing.T) {
+	var g ReplayGuard
+	now := time.Unix(1680000000, 0)
+	ip, _ := netip.ParseAddr("127.0.0.99")
+	id, _ := uuid.Parse("87e79cbc-6df6-4462-8412-85d6c473e3b1")
+
+	messages := make([][]byte, 3)
+	for i := range messages {
+		c := modify(8888, ip, state.CustomUUID(id))
+		c.Nonce = uint64(i + 1)
+		c, err := sign(c, "secret", now)
+		if err != nil {
+			t.Fatalf(`%q`, err)
+		}
+		messages[i], _ = json.Marshal(c)
+	}
+
+	for _, msg := range messages[:2] {
+		err := g.Check(msg)
+		if err != nil {
+			t.Fatalf("expected fresh nonce to be accepted, got %q", err)
+		}
+	}
+	if g.Check(messages[1]) == nil {
+		t.Fatalf("expected duplicate nonce to be rejected")
+	}
+	if g.Check(messages[0]) == nil {
+		t.Fatalf("expected old nonce to be rejected")
+	}
+	if err := g.Check(messages[2]); err != nil {
+		t.Fatalf("expected fresh nonce to be accepted, got %q", err)
+	}
+}
@@ -0,0 +1,47 @@
+package pcsdk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/thefeli73/polemos/state"
+)
+
+// TunnelStats is the traffic a tunnel carried since the proxy started
+type TunnelStats struct {
+	BytesIn           uint64 `json:"bytes_in" yaml:"bytes_in"`
+	BytesOut          uint64 `json:"bytes_out" yaml:"bytes_out"`
+	ActiveConnections uint64 `json:"active_connections" yaml:"active_connections"`
+	TotalConnections  uint64 `json:"total_connections" yaml:"total_connections"`
+}
+
+// ProxyStats is the traffic of every tunnel of a proxy by service UUID
+type ProxyStats struct {
+	Tunnels map[state.CustomUUID]TunnelStats `json:"tunnels"`
+}
+
+// Stats returns the traffic counters of every tunnel of the proxy
+func (p Proxy) Stats(ctx context.Context) (ProxyStats, error) {
+	var s ProxyStats
+	body, err := p.execute(ctx, stats(), true)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal([]byte(body), &s)
+	if err != nil {
+		return s, fmt.Errorf("could not parse stats: %w", err)
+	}
+	if s.Tunnels == nil {
+		s.Tunnels = make(map[state.CustomUUID]TunnelStats)
+	}
+	return s, nil
+}
+
+type commandStats struct{}
+
+func stats() command {
+	c := command{}
+	c.Stats = &commandStats{}
+	return c
+}
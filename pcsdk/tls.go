@@ -0,0 +1,118 @@
+package pcsdk
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[string]*http.Client)
+)
+
+// ClientTLSConfig loads the CA and client certificate used for mutual TLS with a proxy,
+// if pin is set the proxy certificate must also have that hex SHA-256 public key fingerprint
+func ClientTLSConfig(caPath string, certPath string, keyPath string, pin string) (*tls.Config, error) {
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates found in ca")
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load client certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if pin != "" {
+		config.VerifyConnection = VerifyPin(pin)
+	}
+	return config, nil
+}
+
+// VerifyPin returns a tls connection check requiring the peer certificate to match pin
+func VerifyPin(pin string) func(tls.ConnectionState) error {
+	pin = strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no proxy certificate to check pin against")
+		}
+		if Fingerprint(cs.PeerCertificates[0]) != pin {
+			return errors.New("proxy certificate does not match pin")
+		}
+		return nil
+	}
+}
+
+// Fingerprint returns the hex SHA-256 of the public key of a certificate, as used for pinning
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// WithTLS returns a copy of the proxy talking https to the proxy using config
+func (p Proxy) WithTLS(config *tls.Config) Proxy {
+	p.client = httpsClient(config)
+	p.scheme = "https"
+	return p
+}
+
+// WithServerName returns a copy of the proxy checking its certificate against name instead of its address,
+// e.g. for a replacement proxy that is not on the entry ip its certificate is for yet
+func (p Proxy) WithServerName(name string) Proxy {
+	if p.scheme != "https" || p.client == nil {
+		return p
+	}
+	transport, ok := p.client.Transport.(*http.Transport)
+	if !ok || transport.TLSClientConfig == nil {
+		return p
+	}
+	config := transport.TLSClientConfig.Clone()
+	config.ServerName = name
+	p.client = httpsClient(config)
+	return p
+}
+
+func httpsClient(config *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}
+}
+
+// tlsClient returns a shared https client for a set of certificate paths and a pin, so connections are reused.
+// A new client is built when the certificate file changes, e.g. after rotation
+func tlsClient(caPath string, certPath string, keyPath string, pin string) (*http.Client, error) {
+	var modified string
+	if info, err := os.Stat(certPath); err == nil {
+		modified = info.ModTime().String()
+	}
+	key := strings.Join([]string{caPath, certPath, keyPath, pin, modified}, "\x00")
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if client, ok := clients[key]; ok {
+		return client, nil
+	}
+	config, err := ClientTLSConfig(caPath, certPath, keyPath, pin)
+	if err != nil {
+		return nil, err
+	}
+	client := httpsClient(config)
+	clients[key] = client
+	return client, nil
+}
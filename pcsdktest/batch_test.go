@@ -0,0 +1,101 @@
+package pcsdktest
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+// batchFixture returns a fake proxy with two tunnels and a batch touching both and creating a third,
+// whose create fails if conflict is set because its incoming port is already bound
+func batchFixture(t *testing.T, conflict bool) (*Server, *pcsdk.Batch, map[state.CustomUUID]pcsdk.Tunnel) {
+	s := NewSignedServer("secret", 0)
+	t.Cleanup(s.Close)
+	first := state.CustomUUID(uuid.New())
+	second := state.CustomUUID(uuid.New())
+	s.SetTunnel(first, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	s.SetTunnel(second, pcsdk.Tunnel{IncomingPort: 5556, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.2")})
+	before := s.Tunnels()
+
+	port := uint16(5557)
+	if conflict {
+		port = 5555
+	}
+	b := s.Proxy().Batch().
+		Modify(8080, netip.MustParseAddr("10.0.0.3"), first).
+		Delete(second).
+		Create(port, 80, netip.MustParseAddr("10.0.0.4"), state.CustomUUID(uuid.New()))
+	return s, b, before
+}
+
+func TestBatchAtomic(t *testing.T) {
+	s, b, _ := batchFixture(t, false)
+
+	results, err := b.Execute(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("unexpected result %+v", r)
+		}
+	}
+	tunnels := s.Tunnels()
+	if len(tunnels) != 2 || tunnels[results[0].Id].DestinationPort != 8080 {
+		t.Fatalf("batch not applied, got %+v", tunnels)
+	}
+}
+
+func TestBatchAtomicFailureAppliesNothing(t *testing.T) {
+	s, b, before := batchFixture(t, true)
+
+	results, err := b.Execute(context.Background())
+	if !errors.Is(err, pcsdk.ErrPortInUse) {
+		t.Fatalf("expected ErrPortInUse, got %q", err)
+	}
+	if !errors.Is(results[0].Err, pcsdk.ErrAborted) || !errors.Is(results[1].Err, pcsdk.ErrAborted) || !errors.Is(results[2].Err, pcsdk.ErrPortInUse) {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if !reflect.DeepEqual(before, s.Tunnels()) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", before, s.Tunnels())
+	}
+}
+
+func TestBatchSequentialFallback(t *testing.T) {
+	s, b, _ := batchFixture(t, false)
+	s.SetCapabilities(pcsdk.CapabilitySignatures)
+
+	results, err := b.Execute(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	tunnels := s.Tunnels()
+	if len(tunnels) != 2 || tunnels[results[0].Id].DestinationPort != 8080 {
+		t.Fatalf("batch not applied, got %+v", tunnels)
+	}
+}
+
+func TestBatchSequentialRollback(t *testing.T) {
+	s, b, before := batchFixture(t, true)
+	s.SetCapabilities(pcsdk.CapabilitySignatures)
+
+	results, err := b.Execute(context.Background())
+	if !errors.Is(err, pcsdk.ErrPortInUse) {
+		t.Fatalf("expected ErrPortInUse, got %q", err)
+	}
+	if results[0].Op != "modify" || results[1].Op != "delete" || results[2].Op != "create" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if !errors.Is(results[0].Err, pcsdk.ErrAborted) || !errors.Is(results[1].Err, pcsdk.ErrAborted) {
+		t.Fatalf("expected applied operations to be rolled back, got %+v", results)
+	}
+	if !reflect.DeepEqual(before, s.Tunnels()) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", before, s.Tunnels())
+	}
+}
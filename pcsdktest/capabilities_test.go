@@ -0,0 +1,91 @@
+package pcsdktest
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/thefeli73/polemos/pcsdk"
+)
+
+func TestCapabilitiesCached(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy()
+
+	c, err := proxy.Capabilities(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if c.Version != Version || !c.Supports(pcsdk.CapabilityBatch) {
+		t.Fatalf("unexpected capabilities %+v", c)
+	}
+	_, err = proxy.Capabilities(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if s.Received() != 1 {
+		t.Fatalf("expected 1 handshake, got %d commands", s.Received())
+	}
+}
+
+func TestUnsupportedSignatures(t *testing.T) {
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+	s.SetCapabilities()
+
+	err := s.Proxy().Create(context.Background(), 5555, 80, netip.MustParseAddr("10.0.0.1"), testID)
+	if !errors.Is(err, pcsdk.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %q", err)
+	}
+	if s.Received() != 1 || len(s.Tunnels()) != 0 {
+		t.Fatalf("expected only the handshake to be sent, got %d commands", s.Received())
+	}
+}
+
+func TestRequire(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy()
+
+	err := proxy.Require(context.Background(), pcsdk.CapabilityBatch)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	err = proxy.Require(context.Background(), pcsdk.CapabilityUDP)
+	if !errors.Is(err, pcsdk.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %q", err)
+	}
+}
+
+func TestRestartTrackerDetectsRestart(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy()
+	tracker := pcsdk.NewRestartTracker()
+	other := pcsdk.NewRestartTracker()
+
+	status, err := proxy.Status(context.Background())
+	if err != nil || tracker.Observe(proxy.Addr(), status) {
+		t.Fatalf("unexpected first status %+v, %v", status, err)
+	}
+	other.Observe(proxy.Addr(), status)
+	status, _ = proxy.Status(context.Background())
+	if tracker.Observe(proxy.Addr(), status) {
+		t.Fatalf("expected no restart")
+	}
+	s.Restart()
+	status, _ = proxy.Status(context.Background())
+	if !tracker.Observe(proxy.Addr(), status) {
+		t.Fatalf("expected restart to be detected")
+	}
+	status, _ = proxy.Status(context.Background())
+	if tracker.Observe(proxy.Addr(), status) {
+		t.Fatalf("expected restart to be reported once")
+	}
+	// every tracker learns about the restart, even if another one saw it first
+	if !other.Observe(proxy.Addr(), status) {
+		t.Fatalf("expected restart to be detected by every tracker")
+	}
+}
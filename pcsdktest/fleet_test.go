@@ -0,0 +1,97 @@
+package pcsdktest
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+func TestFleet(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	live := s.Addr().Addr()
+	down := netip.MustParseAddr("127.0.0.2")
+	var config state.Config
+	config.MTD.ManagementPort = s.Addr().Port()
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{live: {}, down: {}}
+	s.SetTunnel(testID, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	ctx := context.Background()
+
+	fleet := pcsdk.NewFleet(config)
+	if changed := fleet.Refresh(ctx); len(changed) != 0 {
+		t.Fatalf("expected no health changes on the first check, got %+v", changed)
+	}
+	healthy := fleet.Healthy()
+	if len(healthy) != 1 || healthy[0] != live {
+		t.Fatalf("expected only %s to be healthy, got %v", live, healthy)
+	}
+	fp, _ := fleet.Get(live)
+	if _, ok := fp.Status.Tunnels[testID]; !ok || fp.LastSeen.IsZero() {
+		t.Fatalf("expected the status of %s to be tracked, got %+v", live, fp)
+	}
+
+	s.Restart()
+	fleet.Refresh(ctx)
+	if restarted := fleet.Restarted(); len(restarted) != 1 || restarted[0] != live {
+		t.Fatalf("expected %s to restart, got %v", live, restarted)
+	}
+	fleet.Refresh(ctx)
+	if restarted := fleet.Restarted(); len(restarted) != 0 {
+		t.Fatalf("expected restart to be reported once, got %v", restarted)
+	}
+
+	// a proxy replaced on purpose is not reported as restarting
+	s.Restart()
+	fleet.Replaced(live)
+	fleet.Refresh(ctx)
+	if restarted := fleet.Restarted(); len(restarted) != 0 {
+		t.Fatalf("expected replaced proxy not to restart, got %v", restarted)
+	}
+
+	s.Close()
+	changed := fleet.Refresh(ctx)
+	if len(changed) != 1 || changed[0].Addr != live || changed[0].Healthy {
+		t.Fatalf("expected %s to go down, got %+v", live, changed)
+	}
+
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{live: {}}
+	fleet.Update(config)
+	if len(fleet.Proxies()) != 1 {
+		t.Fatalf("expected %s to be dropped, got %+v", down, fleet.Proxies())
+	}
+}
+
+func TestFleetCommands(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	live := s.Addr().Addr()
+	down := netip.MustParseAddr("127.0.0.2")
+	var config state.Config
+	config.MTD.ManagementPort = s.Addr().Port()
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{live: {}, down: {}}
+	s.SetTunnel(testID, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	ctx := context.Background()
+	fleet := pcsdk.NewFleet(config)
+
+	errs := fleet.Broadcast(ctx, func(ctx context.Context, p pcsdk.Proxy) error {
+		return p.Delete(ctx, testID)
+	})
+	if len(errs) != 1 || errs[down] == nil || len(s.Tunnels()) != 0 {
+		t.Fatalf("expected broadcast to only fail on %s, got %v", down, errs)
+	}
+
+	err := fleet.Target(ctx, live, func(ctx context.Context, p pcsdk.Proxy) error {
+		return p.Create(ctx, 5555, 80, netip.MustParseAddr("10.0.0.1"), testID)
+	})
+	if err != nil || len(s.Tunnels()) != 1 {
+		t.Fatalf("expected tunnel created on %s, got %v %+v", live, err, s.Tunnels())
+	}
+	err = fleet.Target(ctx, netip.MustParseAddr("127.0.0.3"), func(ctx context.Context, p pcsdk.Proxy) error { return nil })
+	if !errors.Is(err, pcsdk.ErrUnknownProxy) {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", pcsdk.ErrUnknownProxy, err)
+	}
+}
@@ -0,0 +1,248 @@
+package pcsdktest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pki"
+	"github.com/thefeli73/polemos/state"
+)
+
+// hubEntry is the entry of the pulling proxy, nothing listens on it so every command has to go through the hub
+var hubEntry = netip.MustParseAddr("192.0.2.10")
+
+func startHub(t *testing.T, config state.Config) (*pcsdk.Hub, *httptest.Server) {
+	hub := pcsdk.NewHub(state.NewRegistry())
+	hub.Update(config)
+	hs := httptest.NewTLSServer(hub)
+	t.Cleanup(hs.Close)
+	return hub, hs
+}
+
+func pull(t *testing.T, s *Server, hub *pcsdk.Hub, url string, client *http.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	errs := make(chan error, 1)
+	go func() { errs <- s.Pull(ctx, url, hubEntry, client) }()
+	for !hub.Connected(hubEntry) {
+		select {
+		case err := <-errs:
+			t.Fatalf(`%q`, err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestHubRelaysCommands(t *testing.T) {
+	var config state.Config
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{hubEntry: {SigningKey: "secret", Pull: true}}
+	hub, hs := startHub(t, config)
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+	pull(t, s, hub, hs.URL, hs.Client())
+
+	control := netip.AddrPortFrom(hubEntry, 14000)
+	pcsdk.ForgetCapabilities(control)
+	proxy := pcsdk.BuildSignedProxy(control, "secret", 0, state.NewNonces()).WithHub(hub).WithTimeout(time.Second)
+	err := proxy.Create(context.Background(), 5555, 80, netip.MustParseAddr("10.0.0.1"), testID)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	status, err := proxy.Status(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if status.Tunnels[testID].DestinationIP != netip.MustParseAddr("10.0.0.1") {
+		t.Fatalf("expected tunnel created through hub, got %+v", status.Tunnels)
+	}
+
+	// errors of the proxy are relayed too
+	err = proxy.Create(context.Background(), 5556, 80, netip.MustParseAddr("10.0.0.1"), testID)
+	if !errors.Is(err, pcsdk.ErrTunnelExists) {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", pcsdk.ErrTunnelExists, err)
+	}
+	if _, ok := hub.Registry().Get(hubEntry); !ok {
+		t.Fatalf("expected proxy to be registered")
+	}
+}
+
+func TestHubRejectsWrongKey(t *testing.T) {
+	var config state.Config
+	config.MTD.SigningKey = "global"
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{hubEntry: {SigningKey: "secret", Pull: true}}
+	_, hs := startHub(t, config)
+
+	for _, key := range []string{"wrong", "global"} {
+		s := NewSignedServer(key, 0)
+		defer s.Close()
+		err := s.Pull(context.Background(), hs.URL, hubEntry, hs.Client())
+		if err == nil {
+			t.Fatalf("expected registration with key %q to fail", key)
+		}
+	}
+}
+
+func TestHubRejectsUnconfiguredProxies(t *testing.T) {
+	var config state.Config
+	config.MTD.SigningKey = "secret"
+	other := netip.MustParseAddr("192.0.2.11")
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{hubEntry: {SigningKey: "secret"}}
+	hub, hs := startHub(t, config)
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+
+	// neither a proxy that does not pull nor one that is not configured at all may register
+	for _, entry := range []netip.Addr{hubEntry, other} {
+		err := s.Pull(context.Background(), hs.URL, entry, hs.Client())
+		if err == nil {
+			t.Fatalf("expected registration of %s to fail", entry)
+		}
+	}
+	if len(hub.Registry().Entries()) != 0 {
+		t.Fatalf("expected no registrations, got %v", hub.Registry().Entries())
+	}
+	if config.MTD.Proxies[hubEntry].Pull {
+		t.Fatalf("expected registration not to make the proxy pull")
+	}
+}
+
+func TestHubRejectsReplays(t *testing.T) {
+	var config state.Config
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{hubEntry: {SigningKey: "secret", Pull: true}}
+	_, hs := startHub(t, config)
+
+	data, err := pcsdk.SignHubRequest(pcsdk.HubRequest{EntryIP: hubEntry, Nonce: 1}, "secret", time.Now())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	for _, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		res, err := hs.Client().Post(hs.URL+"/register", "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf(`%q`, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != expected {
+			t.Fatalf("\nExpected:\t %d\nGot:\t\t %d\n", expected, res.StatusCode)
+		}
+	}
+
+	// requests without a nonce are rejected as well
+	data, _ = pcsdk.SignHubRequest(pcsdk.HubRequest{EntryIP: hubEntry}, "secret", time.Now())
+	res, err := hs.Client().Post(hs.URL+"/register", "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("\nExpected:\t %d\nGot:\t\t %d\n", http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func TestHubNotConnected(t *testing.T) {
+	hub, _ := startHub(t, state.Config{})
+	control := netip.AddrPortFrom(hubEntry, 14000)
+	pcsdk.ForgetCapabilities(control)
+	proxy := pcsdk.BuildProxy(control).WithHub(hub)
+	_, err := proxy.Status(context.Background())
+	if !errors.Is(err, pcsdk.ErrNotConnected) {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", pcsdk.ErrNotConnected, err)
+	}
+
+	// a pulling proxy while no hub is running
+	_, err = pcsdk.BuildProxy(control).WithHub(nil).Status(context.Background())
+	if !errors.Is(err, pcsdk.ErrNotConnected) {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", pcsdk.ErrNotConnected, err)
+	}
+}
+
+func TestHubAuthenticatesCertificate(t *testing.T) {
+	var config state.Config
+	config.MTD.PKI.Dir = t.TempDir()
+	config, err := pki.Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	bundle, err := pki.Enroll(config, hubEntry)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(bundle.CA))
+	cert, err := tls.X509KeyPair([]byte(bundle.Cert), []byte(bundle.Key))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	// no signing key, so only the certificate can authenticate the proxy
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{hubEntry: {Pull: true}}
+	hub := pcsdk.NewHub(state.NewRegistry())
+	hub.Update(config)
+	hs := httptest.NewUnstartedServer(hub)
+	hs.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	hs.StartTLS()
+	defer hs.Close()
+	s := NewServer()
+	defer s.Close()
+
+	err = s.Pull(context.Background(), hs.URL, hubEntry, hs.Client())
+	if err == nil {
+		t.Fatalf("expected registration without certificate to fail")
+	}
+
+	// a new transport, the connection of the failed registration is still open without a certificate
+	transport := hs.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	client := &http.Client{Transport: transport}
+	pull(t, s, hub, hs.URL, client)
+	control := netip.AddrPortFrom(hubEntry, 14000)
+	pcsdk.ForgetCapabilities(control)
+	_, err = pcsdk.BuildProxy(control).WithHub(hub).Status(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+}
+
+func TestHubRequiresTLS(t *testing.T) {
+	var config state.Config
+	config.MTD.PKI.Dir = t.TempDir()
+	config, err := pki.Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{hubEntry: {SigningKey: "secret", Pull: true}}
+	config.MTD.Hub.Listen = "127.0.0.1:0"
+	err = pcsdk.StartHub(config)
+	if err == nil {
+		t.Fatalf("expected hub without certificate not to start")
+	}
+
+	// a hub served in plaintext anyway never hands out commands
+	hub := pcsdk.NewHub(state.NewRegistry())
+	hub.Update(config)
+	hs := httptest.NewServer(hub)
+	defer hs.Close()
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+	err = s.Pull(context.Background(), hs.URL, hubEntry, nil)
+	if err == nil {
+		t.Fatalf("expected registration over plaintext to fail")
+	}
+
+	defaultHub := pcsdk.DefaultHub
+	pcsdk.DefaultHub = hub
+	defer func() { pcsdk.DefaultHub = defaultHub }()
+	pcsdk.ForgetCapabilities(config.ManagementAddr(hubEntry))
+	_, err = pcsdk.ProxyFromConfig(config, hubEntry).WithTimeout(time.Second).Status(context.Background())
+	if !errors.Is(err, pcsdk.ErrNotConnected) {
+		t.Fatalf("\nExpected:\t %q\nGot:\t\t %q\n", pcsdk.ErrNotConnected, err)
+	}
+}
@@ -0,0 +1,85 @@
+package pcsdktest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"time"
+
+	"github.com/thefeli73/polemos/pcsdk"
+)
+
+// Pull registers the fake proxy as entry with the hub on hubURL and handles the commands it polls from it until ctx is
+// done, as a proxy behind NAT would. Requests are signed with the key of the fake proxy, or only authenticated by the
+// client certificate of client if it has none. Nonces start at the current time, so they keep increasing across pulls
+func (s *Server) Pull(ctx context.Context, hubURL string, entry netip.Addr, client *http.Client) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	nonce := uint64(time.Now().UnixNano())
+	next := func() uint64 {
+		nonce++
+		return nonce
+	}
+	_, err := s.hubRequest(ctx, client, hubURL+"/register", pcsdk.HubRequest{EntryIP: entry, Nonce: next()})
+	if err != nil {
+		return fmt.Errorf("could not register: %w", err)
+	}
+	for ctx.Err() == nil {
+		body, err := s.hubRequest(ctx, client, hubURL+"/poll", pcsdk.HubRequest{EntryIP: entry, Nonce: next()})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("could not poll: %w", err)
+		}
+		if len(body) == 0 {
+			continue
+		}
+		var c pcsdk.HubCommand
+		err = json.Unmarshal(body, &c)
+		if err != nil {
+			return fmt.Errorf("could not parse command: %w", err)
+		}
+
+		// handle it exactly like a command posted to the management port
+		rec := httptest.NewRecorder()
+		s.handleCommand(rec, httptest.NewRequest(http.MethodPost, "/command", bytes.NewReader(c.Command)))
+		_, err = s.hubRequest(ctx, client, hubURL+"/result", pcsdk.HubRequest{EntryIP: entry, Nonce: next(), Id: c.Id,
+			StatusCode: rec.Code, Body: rec.Body.String()})
+		if err != nil && ctx.Err() == nil {
+			return fmt.Errorf("could not send result: %w", err)
+		}
+	}
+	return ctx.Err()
+}
+
+func (s *Server) hubRequest(ctx context.Context, client *http.Client, url string, req pcsdk.HubRequest) ([]byte, error) {
+	data, err := pcsdk.SignHubRequest(req, s.key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("hub answered %d: %s", res.StatusCode, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,581 @@
+// Package pcsdktest provides an in-process fake Proxima Centauri for testing code built on pcsdk
+package pcsdktest
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+// Version is the version the fake proxy reports in its status
+const Version = "pcsdktest"
+
+// Server is a fake proxy serving the /command endpoint and keeping a tunnel table in memory
+type Server struct {
+	mu           sync.Mutex
+	server       *httptest.Server
+	key          string
+	skew         time.Duration
+	guard        pcsdk.ReplayGuard
+	started      time.Time
+	bootID       string
+	tunnels      map[state.CustomUUID]pcsdk.Tunnel
+	stats        map[state.CustomUUID]pcsdk.TunnelStats
+	latency      time.Duration
+	failures     []failure
+	received     int
+	capabilities []string
+	certificate  []byte
+}
+
+type failure struct {
+	statusCode int
+	code       string
+}
+
+// command mirrors the wire format of the commands sent by pcsdk
+type command struct {
+	Create *struct {
+		IncomingPort    uint16          `json:"incoming_port"`
+		DestinationPort uint16          `json:"destination_port"`
+		DestinationIP   netip.Addr      `json:"destination_ip"`
+		Id              string          `json:"id"`
+		Backends        []pcsdk.Backend `json:"backends"`
+		Protocol        string          `json:"protocol"`
+		AllowedSources  []netip.Prefix  `json:"allowed_sources"`
+		pcsdk.Limits
+		ProxyProtocol uint8 `json:"proxy_protocol"`
+	} `json:"create"`
+	Modify *struct {
+		DestinationPort uint16          `json:"destination_port"`
+		DestinationIP   netip.Addr      `json:"destination_ip"`
+		Id              string          `json:"id"`
+		DrainGrace      uint64          `json:"drain_grace"`
+		Backends        []pcsdk.Backend `json:"backends"`
+		AllowedSources  []netip.Prefix  `json:"allowed_sources"`
+		pcsdk.Limits
+		ProxyProtocol uint8 `json:"proxy_protocol"`
+	} `json:"modify"`
+	Delete *struct {
+		Id string `json:"id"`
+	} `json:"delete"`
+	Status      *struct{} `json:"status"`
+	Stats       *struct{} `json:"stats"`
+	Certificate *struct {
+		Cert string `json:"cert"`
+	} `json:"certificate"`
+	Batch []command `json:"batch"`
+}
+
+// NewServer starts a fake proxy accepting unsigned commands
+func NewServer() *Server {
+	return NewSignedServer("", 0)
+}
+
+// NewSignedServer starts a fake proxy only accepting commands signed with key and carrying a fresh nonce
+func NewSignedServer(key string, skew time.Duration) *Server {
+	return NewTLSServer(key, skew, nil)
+}
+
+// NewTLSServer starts a fake proxy serving https with config, use Proxy().WithTLS to talk to it.
+// Signatures are required if key is set
+func NewTLSServer(key string, skew time.Duration, config *tls.Config) *Server {
+	s := &Server{
+		key:          key,
+		skew:         skew,
+		started:      time.Now(),
+		bootID:       uuid.NewString(),
+		tunnels:      make(map[state.CustomUUID]pcsdk.Tunnel),
+		stats:        make(map[state.CustomUUID]pcsdk.TunnelStats),
+		capabilities: []string{pcsdk.CapabilitySignatures, pcsdk.CapabilityBatch, pcsdk.CapabilityDrain, pcsdk.CapabilityWeighted, pcsdk.CapabilityAllowlist, pcsdk.CapabilityLimits, pcsdk.CapabilityStats, pcsdk.CapabilityProxyProto, pcsdk.CapabilityCertificate},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/command", s.handleCommand)
+	s.server = httptest.NewUnstartedServer(mux)
+	if config == nil {
+		s.server.Start()
+	} else {
+		s.server.TLS = config
+		s.server.StartTLS()
+	}
+	pcsdk.ForgetCapabilities(s.Addr())
+	return s
+}
+
+// Close shuts the fake proxy down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Addr returns the management address of the fake proxy
+func (s *Server) Addr() netip.AddrPort {
+	return netip.MustParseAddrPort(s.server.Listener.Addr().String())
+}
+
+// Proxy returns a pcsdk.Proxy talking to the fake proxy, signed if the fake proxy requires it
+func (s *Server) Proxy() pcsdk.Proxy {
+	if s.key == "" {
+		return pcsdk.BuildProxy(s.Addr()).WithClient(s.server.Client())
+	}
+	return pcsdk.BuildSignedProxy(s.Addr(), s.key, s.skew, state.NewNonces()).WithClient(s.server.Client())
+}
+
+// Tunnels returns a copy of the current tunnel table
+func (s *Server) Tunnels() map[state.CustomUUID]pcsdk.Tunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tunnels := make(map[state.CustomUUID]pcsdk.Tunnel, len(s.tunnels))
+	for id, t := range s.tunnels {
+		tunnels[id] = t
+	}
+	return tunnels
+}
+
+// SetTunnel adds or replaces a tunnel behind the back of Polemos, as a manual change would
+func (s *Server) SetTunnel(id state.CustomUUID, t pcsdk.Tunnel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels[id] = t
+}
+
+// SetDraining sets the number of connections of a tunnel still open to previous destinations
+func (s *Server) SetDraining(id state.CustomUUID, connections uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tunnels[id]
+	t.Draining = connections
+	s.tunnels[id] = t
+}
+
+// SetConnections sets the number of open and rejected connections the fake proxy reports for a tunnel
+func (s *Server) SetConnections(id state.CustomUUID, connections uint64, rejected uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tunnels[id]
+	t.Connections = connections
+	t.Rejected = rejected
+	s.tunnels[id] = t
+}
+
+// SetStats sets the traffic counters the fake proxy reports for a tunnel
+func (s *Server) SetStats(id state.CustomUUID, stats pcsdk.TunnelStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats[id] = stats
+}
+
+// SetBackendFailures sets the number of failed connections the fake proxy reports for a backend of a tunnel
+func (s *Server) SetBackendFailures(id state.CustomUUID, ip netip.Addr, failures uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tunnels[id]
+	t.Backends = append([]pcsdk.Backend(nil), t.Backends...)
+	for i := range t.Backends {
+		if t.Backends[i].IP == ip {
+			t.Backends[i].Failures = failures
+		}
+	}
+	s.tunnels[id] = t
+}
+
+// Restart empties the tunnel table, resets the uptime and gets a new boot id, as a restarted proxy would
+func (s *Server) Restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnels = make(map[state.CustomUUID]pcsdk.Tunnel)
+	s.stats = make(map[state.CustomUUID]pcsdk.TunnelStats)
+	s.started = time.Now()
+	s.bootID = uuid.NewString()
+}
+
+// SetCapabilities replaces the capabilities the fake proxy advertises and honours, e.g. to act as an older proxy.
+// It starts with every capability but udp
+func (s *Server) SetCapabilities(capabilities ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capabilities = capabilities
+	pcsdk.ForgetCapabilities(s.Addr())
+}
+
+// Certificate returns the last certificate installed on the fake proxy, nil if none was
+func (s *Server) Certificate() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.certificate
+}
+
+// installCertificate keeps certPEM if it is issued for the key the fake proxy serves https with, as a proxy would.
+// The connections keep using the certificate the fake proxy was started with
+func (s *Server) installCertificate(certPEM []byte) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return errors.New("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if s.server.TLS != nil && len(s.server.TLS.Certificates) > 0 {
+		key, ok := s.server.TLS.Certificates[0].PrivateKey.(interface{ Public() crypto.PublicKey })
+		if !ok || !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(cert.PublicKey) {
+			return errors.New("certificate does not match the key of the proxy")
+		}
+	}
+	s.certificate = certPEM
+	return nil
+}
+
+func (s *Server) supports(capability string) bool {
+	for _, c := range s.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLatency delays every following response by latency
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// FailNext makes the next count commands fail with statusCode and the error code of the proxy
+func (s *Server) FailNext(count int, statusCode int, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < count; i++ {
+		s.failures = append(s.failures, failure{statusCode, code})
+	}
+}
+
+// Received returns the number of commands the fake proxy has received
+func (s *Server) Received() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+func (s *Server) handleCommand(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.received++
+	latency := s.latency
+	var fail *failure
+	if len(s.failures) > 0 {
+		fail = &s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	s.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(latency):
+		}
+	}
+	if fail != nil {
+		writeError(w, fail.statusCode, fail.code, "injected failure")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "bad_request", "commands must be posted")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if s.key != "" {
+		err = pcsdk.VerifyCommand(data, s.key, s.skew, time.Now())
+		if err == nil {
+			err = s.guard.Check(data)
+		}
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+			return
+		}
+	}
+	var c command
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case c.Status != nil:
+		status := pcsdk.ProxyStatus{
+			Version:      Version,
+			Uptime:       uint64(time.Since(s.started).Seconds()),
+			Tunnels:      s.tunnels,
+			Capabilities: s.capabilities,
+			BootID:       s.bootID,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case c.Stats != nil:
+		if !s.supports(pcsdk.CapabilityStats) {
+			writeError(w, http.StatusBadRequest, "bad_request", "stats not supported")
+			return
+		}
+		stats := pcsdk.ProxyStats{Tunnels: make(map[state.CustomUUID]pcsdk.TunnelStats)}
+		for id := range s.tunnels {
+			stats.Tunnels[id] = s.stats[id]
+		}
+		writeJSON(w, http.StatusOK, stats)
+	case c.Certificate != nil:
+		if !s.supports(pcsdk.CapabilityCertificate) {
+			writeError(w, http.StatusBadRequest, "bad_request", "certificate not supported")
+			return
+		}
+		err = s.installCertificate([]byte(c.Certificate.Cert))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case c.Modify != nil && c.Modify.DrainGrace > 0 && !s.supports(pcsdk.CapabilityDrain):
+		writeError(w, http.StatusBadRequest, "bad_request", "drain not supported")
+	case weighted(c) && !s.supports(pcsdk.CapabilityWeighted):
+		writeError(w, http.StatusBadRequest, "bad_request", "weighted backends not supported")
+	case allowlist(c) && !s.supports(pcsdk.CapabilityAllowlist):
+		writeError(w, http.StatusBadRequest, "bad_request", "allowed sources not supported")
+	case limited(c) && !s.supports(pcsdk.CapabilityLimits):
+		writeError(w, http.StatusBadRequest, "bad_request", "limits not supported")
+	case proxyProtocol(c) && !s.supports(pcsdk.CapabilityProxyProto):
+		writeError(w, http.StatusBadRequest, "bad_request", "proxy protocol not supported")
+	case udp(c) && !s.supports(pcsdk.CapabilityUDP):
+		writeError(w, http.StatusBadRequest, "bad_request", "udp not supported")
+	case c.Batch != nil:
+		if !s.supports(pcsdk.CapabilityBatch) {
+			writeError(w, http.StatusBadRequest, "bad_request", "batch not supported")
+			return
+		}
+		s.applyBatch(w, c.Batch)
+	default:
+		res := apply(s.tunnels, c)
+		if res.Code != "" {
+			writeJSON(w, res.statusCode, res)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// weighted returns if any operation of c sets weighted backends
+func weighted(c command) bool {
+	if (c.Create != nil && len(c.Create.Backends) > 0) || (c.Modify != nil && len(c.Modify.Backends) > 0) {
+		return true
+	}
+	for _, op := range c.Batch {
+		if weighted(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowlist returns if any operation of c restricts the sources of a tunnel
+func allowlist(c command) bool {
+	if (c.Create != nil && len(c.Create.AllowedSources) > 0) || (c.Modify != nil && len(c.Modify.AllowedSources) > 0) {
+		return true
+	}
+	for _, op := range c.Batch {
+		if allowlist(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// limited returns if any operation of c limits the connections of a tunnel
+func limited(c command) bool {
+	if (c.Create != nil && c.Create.Limits != pcsdk.Limits{}) || (c.Modify != nil && c.Modify.Limits != pcsdk.Limits{}) {
+		return true
+	}
+	for _, op := range c.Batch {
+		if limited(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocol returns if any operation of c prepends a PROXY protocol header
+func proxyProtocol(c command) bool {
+	if (c.Create != nil && c.Create.ProxyProtocol > 0) || (c.Modify != nil && c.Modify.ProxyProtocol > 0) {
+		return true
+	}
+	for _, op := range c.Batch {
+		if proxyProtocol(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// udp returns if any operation of c creates an udp tunnel
+func udp(c command) bool {
+	if c.Create != nil && c.Create.Protocol == pcsdk.ProtocolUDP {
+		return true
+	}
+	for _, op := range c.Batch {
+		if udp(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBatch applies all operations to a copy of the tunnel table, committing it only if all succeeded
+func (s *Server) applyBatch(w http.ResponseWriter, ops []command) {
+	tunnels := make(map[state.CustomUUID]pcsdk.Tunnel, len(s.tunnels))
+	for id, t := range s.tunnels {
+		tunnels[id] = t
+	}
+	results := make([]result, len(ops))
+	failed := -1
+	for i, op := range ops {
+		results[i] = apply(tunnels, op)
+		if results[i].Code != "" {
+			failed = i
+			break
+		}
+	}
+	if failed < 0 {
+		s.tunnels = tunnels
+		writeJSON(w, http.StatusOK, result{Results: results})
+		return
+	}
+	for i := range results {
+		if i != failed {
+			results[i] = result{Code: "aborted", Message: "batch not applied"}
+		}
+	}
+	writeJSON(w, results[failed].statusCode, result{
+		Code:    results[failed].Code,
+		Message: results[failed].Message,
+		Results: results,
+	})
+}
+
+// result is the outcome of a single operation, as serialized by the proxy
+type result struct {
+	statusCode int
+	Code       string   `json:"code,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	Results    []result `json:"results,omitempty"`
+}
+
+func failed(statusCode int, code string, message string) result {
+	return result{statusCode: statusCode, Code: code, Message: message}
+}
+
+// apply applies a single create, modify or delete operation to tunnels
+func apply(tunnels map[state.CustomUUID]pcsdk.Tunnel, c command) result {
+	switch {
+	case c.Create != nil:
+		id, err := uuid.Parse(c.Create.Id)
+		if err != nil {
+			return failed(http.StatusBadRequest, "bad_request", err.Error())
+		}
+		if c.Create.ProxyProtocol > pcsdk.ProxyProtocolV2 {
+			return failed(http.StatusBadRequest, "bad_request", "unknown proxy protocol version")
+		}
+		if _, exists := tunnels[state.CustomUUID(id)]; exists {
+			return failed(http.StatusConflict, "tunnel_exists", c.Create.Id)
+		}
+		requested := pcsdk.Tunnel{Protocol: c.Create.Protocol}
+		for _, t := range tunnels {
+			// tcp and udp ports are bound independently
+			if t.IncomingPort == c.Create.IncomingPort && t.Network() == requested.Network() {
+				return failed(http.StatusConflict, "port_in_use", "port already bound")
+			}
+		}
+		tunnels[state.CustomUUID(id)] = pcsdk.Tunnel{
+			IncomingPort:    c.Create.IncomingPort,
+			DestinationPort: c.Create.DestinationPort,
+			DestinationIP:   c.Create.DestinationIP,
+			Backends:        c.Create.Backends,
+			Protocol:        c.Create.Protocol,
+			AllowedSources:  c.Create.AllowedSources,
+			Limits:          c.Create.Limits,
+			ProxyProtocol:   c.Create.ProxyProtocol,
+		}
+	case c.Modify != nil:
+		id, err := uuid.Parse(c.Modify.Id)
+		if err != nil {
+			return failed(http.StatusBadRequest, "bad_request", err.Error())
+		}
+		t, exists := tunnels[state.CustomUUID(id)]
+		if !exists {
+			return failed(http.StatusNotFound, "tunnel_not_found", c.Modify.Id)
+		}
+		t.DestinationPort = c.Modify.DestinationPort
+		t.DestinationIP = c.Modify.DestinationIP
+		t.Backends = backends(c.Modify.Backends, t.Backends)
+		t.AllowedSources = c.Modify.AllowedSources
+		if c.Modify.ProxyProtocol > pcsdk.ProxyProtocolV2 {
+			return failed(http.StatusBadRequest, "bad_request", "unknown proxy protocol version")
+		}
+		t.Limits = c.Modify.Limits
+		t.ProxyProtocol = c.Modify.ProxyProtocol
+		if c.Modify.DrainGrace == 0 {
+			// without draining existing connections are cut
+			t.Draining = 0
+		}
+		tunnels[state.CustomUUID(id)] = t
+	case c.Delete != nil:
+		id, err := uuid.Parse(c.Delete.Id)
+		if err != nil {
+			return failed(http.StatusBadRequest, "bad_request", err.Error())
+		}
+		if _, exists := tunnels[state.CustomUUID(id)]; !exists {
+			return failed(http.StatusNotFound, "tunnel_not_found", c.Delete.Id)
+		}
+		delete(tunnels, state.CustomUUID(id))
+	default:
+		return failed(http.StatusBadRequest, "bad_request", "empty command")
+	}
+	return result{}
+}
+
+// backends returns the new backends of a tunnel, keeping the failures reported for backends that remain
+func backends(next []pcsdk.Backend, prev []pcsdk.Backend) []pcsdk.Backend {
+	for i := range next {
+		for _, b := range prev {
+			if b.IP == next[i].IP && b.Port == next[i].Port {
+				next[i].Failures = b.Failures
+			}
+		}
+	}
+	return next
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code string, message string) {
+	writeJSON(w, statusCode, failed(statusCode, code, message))
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,267 @@
+package pcsdktest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+var testID = state.CustomUUID(uuid.MustParse("87e79cbc-6df6-4462-8412-85d6c473e3b1"))
+
+func TestCreateModifyDelete(t *testing.T) {
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+	proxy := s.Proxy()
+	ctx := context.Background()
+	ip := netip.MustParseAddr("127.0.0.99")
+
+	err := proxy.Create(ctx, 5555, 6666, ip, testID)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	err = proxy.Create(ctx, 5555, 6666, ip, testID)
+	if !errors.Is(err, pcsdk.ErrTunnelExists) {
+		t.Fatalf("expected ErrTunnelExists, got %q", err)
+	}
+
+	newIP := netip.MustParseAddr("127.0.0.100")
+	err = proxy.Modify(ctx, 7777, newIP, testID)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	status, err := proxy.Status(ctx)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	expected := pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 7777, DestinationIP: newIP}
+	if status.Version != Version || !status.Tunnels[testID].Matches(expected) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", expected, status)
+	}
+
+	err = proxy.Delete(ctx, testID)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	err = proxy.Delete(ctx, testID)
+	if !errors.Is(err, pcsdk.ErrTunnelNotFound) {
+		t.Fatalf("expected ErrTunnelNotFound, got %q", err)
+	}
+	if len(s.Tunnels()) != 0 {
+		t.Fatalf("expected no tunnels, got %+v", s.Tunnels())
+	}
+}
+
+func TestUDPCreateModifyDelete(t *testing.T) {
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+	s.SetCapabilities(pcsdk.CapabilitySignatures, pcsdk.CapabilityUDP)
+	proxy := s.Proxy()
+	ctx := context.Background()
+	ip := netip.MustParseAddr("127.0.0.99")
+	tcpID := state.CustomUUID(uuid.New())
+
+	err := proxy.CreateTunnel(ctx, testID, pcsdk.Tunnel{IncomingPort: 53, DestinationPort: 5353, DestinationIP: ip, Protocol: pcsdk.ProtocolUDP})
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	// the same port is free for tcp
+	err = proxy.Create(ctx, 53, 5353, ip, tcpID)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	err = proxy.CreateTunnel(ctx, state.CustomUUID(uuid.New()), pcsdk.Tunnel{IncomingPort: 53, DestinationPort: 5353, DestinationIP: ip, Protocol: pcsdk.ProtocolUDP})
+	if !errors.Is(err, pcsdk.ErrPortInUse) {
+		t.Fatalf("expected ErrPortInUse, got %q", err)
+	}
+
+	newIP := netip.MustParseAddr("127.0.0.100")
+	err = proxy.Modify(ctx, 5353, newIP, testID)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	status, err := proxy.Status(ctx)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	expected := pcsdk.Tunnel{IncomingPort: 53, DestinationPort: 5353, DestinationIP: newIP, Protocol: pcsdk.ProtocolUDP}
+	if !status.Tunnels[testID].Matches(expected) || status.Tunnels[tcpID].Network() != pcsdk.ProtocolTCP {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", expected, status.Tunnels)
+	}
+
+	err = proxy.Delete(ctx, testID)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if _, ok := s.Tunnels()[testID]; ok || len(s.Tunnels()) != 1 {
+		t.Fatalf("expected only the tcp tunnel, got %+v", s.Tunnels())
+	}
+}
+
+func TestUDPUnsupported(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy()
+
+	err := proxy.CreateTunnel(context.Background(), testID, pcsdk.Tunnel{IncomingPort: 53, DestinationPort: 53,
+		DestinationIP: netip.MustParseAddr("127.0.0.99"), Protocol: pcsdk.ProtocolUDP})
+	if !errors.Is(err, pcsdk.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %q", err)
+	}
+	if len(s.Tunnels()) != 0 {
+		t.Fatalf("expected no tunnels, got %+v", s.Tunnels())
+	}
+}
+
+func TestRejectsWrongKey(t *testing.T) {
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+	proxy := pcsdk.BuildSignedProxy(s.Addr(), "other", 0, state.NewNonces())
+
+	_, err := proxy.Status(context.Background())
+	if !errors.Is(err, pcsdk.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %q", err)
+	}
+}
+
+func TestRejectsUnsigned(t *testing.T) {
+	s := NewSignedServer("secret", 0)
+	defer s.Close()
+	proxy := pcsdk.BuildProxy(s.Addr())
+
+	err := proxy.Create(context.Background(), 5555, 6666, netip.MustParseAddr("127.0.0.99"), testID)
+	if !errors.Is(err, pcsdk.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %q", err)
+	}
+	if len(s.Tunnels()) != 0 {
+		t.Fatalf("expected no tunnels, got %+v", s.Tunnels())
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy().WithRetries(1, time.Millisecond)
+
+	s.FailNext(1, http.StatusServiceUnavailable, "internal")
+	_, err := proxy.Status(context.Background())
+	if err != nil {
+		t.Fatalf("expected retry to succeed, got %q", err)
+	}
+	if s.Received() != 2 {
+		t.Fatalf("expected 2 commands, got %d", s.Received())
+	}
+
+	s.FailNext(1, http.StatusConflict, "port_in_use")
+	err = proxy.Create(context.Background(), 5555, 6666, netip.MustParseAddr("127.0.0.99"), testID)
+	if !errors.Is(err, pcsdk.ErrPortInUse) {
+		t.Fatalf("expected ErrPortInUse, got %q", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetLatency(200 * time.Millisecond)
+	proxy := s.Proxy().WithTimeout(20 * time.Millisecond)
+
+	_, err := proxy.Status(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %q", err)
+	}
+}
+
+func TestAllowedSources(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy()
+	ctx := context.Background()
+	tunnel := pcsdk.Tunnel{IncomingPort: 22, DestinationPort: 22, DestinationIP: netip.MustParseAddr("127.0.0.99"),
+		AllowedSources: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}
+
+	err := proxy.CreateTunnel(ctx, testID, tunnel)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if !s.Tunnels()[testID].Matches(tunnel) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", tunnel, s.Tunnels()[testID])
+	}
+
+	tunnel.AllowedSources = append(tunnel.AllowedSources, netip.MustParsePrefix("2001:db8::/32"))
+	err = proxy.ModifyTunnel(ctx, testID, tunnel)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if !s.Tunnels()[testID].Matches(tunnel) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", tunnel, s.Tunnels()[testID])
+	}
+
+	s.SetCapabilities(pcsdk.CapabilityBatch)
+	err = proxy.ModifyTunnel(ctx, testID, tunnel)
+	if !errors.Is(err, pcsdk.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %q", err)
+	}
+}
+
+func TestLimitsAndUsage(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy()
+	ctx := context.Background()
+	tunnel := pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 6666, DestinationIP: netip.MustParseAddr("127.0.0.99"),
+		Limits: pcsdk.Limits{MaxConnections: 2, ConnectionRate: 1}}
+
+	err := proxy.CreateTunnel(ctx, testID, tunnel)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	s.SetConnections(testID, 2, 7)
+	status, err := proxy.Status(ctx)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	got := status.Tunnels[testID]
+	if !got.Matches(tunnel) || !got.AtLimit() || got.Usage() != "2/2 connections, 7 rejected" {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", tunnel, got)
+	}
+
+	s.SetCapabilities(pcsdk.CapabilityBatch)
+	err = proxy.ModifyTunnel(ctx, testID, tunnel)
+	if !errors.Is(err, pcsdk.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %q", err)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	proxy := s.Proxy()
+	ctx := context.Background()
+	tunnel := pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 6666, DestinationIP: netip.MustParseAddr("127.0.0.99"),
+		ProxyProtocol: pcsdk.ProxyProtocolV1}
+
+	err := proxy.CreateTunnel(ctx, testID, tunnel)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	tunnel.ProxyProtocol = pcsdk.ProxyProtocolV2
+	err = proxy.ModifyTunnel(ctx, testID, tunnel)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if !s.Tunnels()[testID].Matches(tunnel) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", tunnel, s.Tunnels()[testID])
+	}
+
+	tunnel.ProxyProtocol = 3
+	err = proxy.ModifyTunnel(ctx, testID, tunnel)
+	if !errors.Is(err, pcsdk.ErrBadRequest) {
+		t.Fatalf("expected ErrBadRequest, got %q", err)
+	}
+}
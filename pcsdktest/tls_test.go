@@ -0,0 +1,137 @@
+package pcsdktest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thefeli73/polemos/pcsdk"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func issue(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert, key, der}
+}
+
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	keyDER, _ := x509.MarshalECPrivateKey(c.key)
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certPath, keyPath
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func mutualTLSServer(t *testing.T) (*Server, *testCert, string, string, string) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil, true, 0)
+	server := issue(t, "proxy", ca, false, x509.ExtKeyUsageServerAuth)
+	client := issue(t, "polemos", ca, false, x509.ExtKeyUsageClientAuth)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := client.write(t, dir, "client")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	s := NewTLSServer("", 0, &tls.Config{
+		Certificates: []tls.Certificate{server.tls()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	t.Cleanup(s.Close)
+	return s, server, caPath, certPath, keyPath
+}
+
+func TestMutualTLS(t *testing.T) {
+	s, server, caPath, certPath, keyPath := mutualTLSServer(t)
+
+	config, err := pcsdk.ClientTLSConfig(caPath, certPath, keyPath, pcsdk.Fingerprint(server.cert))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	_, err = s.Proxy().WithTLS(config).Status(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+}
+
+func TestMutualTLSRequiresClientCert(t *testing.T) {
+	s, _, caPath, _, _ := mutualTLSServer(t)
+
+	pool := x509.NewCertPool()
+	caPEM, _ := os.ReadFile(caPath)
+	pool.AppendCertsFromPEM(caPEM)
+	_, err := s.Proxy().WithTLS(&tls.Config{RootCAs: pool}).Status(context.Background())
+	if err == nil {
+		t.Fatalf("expected proxy to reject client without certificate")
+	}
+}
+
+func TestMutualTLSRejectsWrongPin(t *testing.T) {
+	s, _, caPath, certPath, keyPath := mutualTLSServer(t)
+
+	config, err := pcsdk.ClientTLSConfig(caPath, certPath, keyPath, "00112233")
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	_, err = s.Proxy().WithTLS(config).Status(context.Background())
+	if err == nil {
+		t.Fatalf("expected pinned proxy certificate mismatch to fail")
+	}
+}
+
+func TestPlaintextProxyRejected(t *testing.T) {
+	s, _, _, _, _ := mutualTLSServer(t)
+
+	_, err := s.Proxy().Status(context.Background())
+	if err == nil {
+		t.Fatalf("expected plaintext command to fail against tls proxy")
+	}
+}
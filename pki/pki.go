@@ -0,0 +1,236 @@
+// Package pki is a small certificate authority issuing the certificates for mutual TLS between Polemos and its proxies
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CALifetime is how long the root certificate is valid
+const CALifetime = 10 * 365 * 24 * time.Hour
+
+// Authority is a root CA stored as ca.crt and ca.key in a directory
+type Authority struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// LoadOrCreate loads the CA in dir, generating a new root if there is none
+func LoadOrCreate(dir string) (*Authority, error) {
+	a := &Authority{dir: dir}
+	cert, key, err := load(a.CAPath(), filepath.Join(dir, "ca.key"))
+	if err == nil {
+		a.cert, a.key = cert, key
+		return a, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := newTemplate("Polemos CA", CALifetime)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	a.cert, _ = x509.ParseCertificate(der)
+	a.key = key
+	err = write(a.CAPath(), filepath.Join(dir, "ca.key"), der, key)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Created certificate authority:\t", a.CAPath())
+	return a, nil
+}
+
+// CAPath returns the path of the root certificate
+func (a *Authority) CAPath() string {
+	return filepath.Join(a.dir, "ca.crt")
+}
+
+// CAPEM returns the root certificate in pem
+func (a *Authority) CAPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.cert.Raw})
+}
+
+// ClientPaths returns the certificate and key paths of the Polemos client certificate
+func (a *Authority) ClientPaths() (string, string) {
+	return filepath.Join(a.dir, "polemos.crt"), filepath.Join(a.dir, "polemos.key")
+}
+
+// ProxyPaths returns the certificate and key paths of the server certificate of the proxy on entry
+func (a *Authority) ProxyPaths(entry netip.Addr) (string, string) {
+	name := entry.StringExpanded()
+	return filepath.Join(a.dir, "proxies", name+".crt"), filepath.Join(a.dir, "proxies", name+".key")
+}
+
+// Issue signs a new key for name, valid for lifetime, as a server certificate for ips if server is set and a client certificate otherwise
+func (a *Authority) Issue(name string, ips []netip.Addr, server bool, lifetime time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err := a.sign(name, ips, server, lifetime, &key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// Reissue signs the key at keyPath again like Issue, so a certificate is renewed without changing its public key
+func (a *Authority) Reissue(keyPath string, name string, ips []netip.Addr, server bool, lifetime time.Duration) ([]byte, error) {
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return a.sign(name, ips, server, lifetime, &key.PublicKey)
+}
+
+// sign returns the certificate for pub as described by Issue, in pem
+func (a *Authority) sign(name string, ips []netip.Addr, server bool, lifetime time.Duration, pub *ecdsa.PublicKey) ([]byte, error) {
+	template, err := newTemplate(name, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if server {
+		// proxies also authenticate with their certificate when pulling commands from the hub
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	} else {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	for _, ip := range ips {
+		template.IPAddresses = append(template.IPAddresses, net.IP(ip.AsSlice()))
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, pub, a.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// Renew issues a certificate to certPath and keyPath if there is none or it expires within before, returning if it did
+func (a *Authority) Renew(certPath string, keyPath string, name string, ips []netip.Addr, server bool, lifetime time.Duration, before time.Duration) (bool, error) {
+	if !NeedsRenewal(certPath, before) {
+		return false, nil
+	}
+	certPEM, keyPEM, err := a.Issue(name, ips, server, lifetime)
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(filepath.Dir(certPath), 0700)
+	if err != nil {
+		return false, err
+	}
+	// write the key first, a certificate without matching key is worse than a stale pair
+	err = ioutil.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return false, err
+	}
+	err = ioutil.WriteFile(certPath, certPEM, 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NeedsRenewal returns true if the certificate at certPath is missing, unreadable or expires within before
+func NeedsRenewal(certPath string, before time.Duration) bool {
+	cert, err := readCert(certPath)
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(before).After(cert.NotAfter)
+}
+
+func newTemplate(name string, lifetime time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(lifetime),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+func readCert(certPath string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate in %s", certPath)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func load(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := readCert(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func loadKey(keyPath string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no key in %s", keyPath)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func write(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
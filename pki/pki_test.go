@@ -0,0 +1,178 @@
+package pki
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/state"
+)
+
+func testConfig(t *testing.T) state.Config {
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	config.MTD.PKI.Dir = t.TempDir()
+	config.MTD.ManagementPort = 14000
+	return config
+}
+
+func TestLoadOrCreateKeepsCA(t *testing.T) {
+	dir := t.TempDir()
+	a, err := LoadOrCreate(dir)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	b, err := LoadOrCreate(dir)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if string(a.CAPEM()) != string(b.CAPEM()) {
+		t.Fatalf("expected existing CA to be loaded")
+	}
+}
+
+func TestRotateRenewsOnlyClientCertificate(t *testing.T) {
+	config := testConfig(t)
+	entry := netip.MustParseAddr("127.0.0.1")
+	config.MTD.Services[state.CustomUUID(uuid.New())] = state.Service{EntryIP: entry}
+
+	config, err := Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	a, _ := LoadOrCreate(config.MTD.PKI.Dir)
+	certPath, _ := a.ProxyPaths(entry)
+	if config.MTD.TLS.CAPath != a.CAPath() || NeedsRenewal(config.MTD.TLS.CertPath, time.Hour) {
+		t.Fatalf("expected client certificate, got %+v", config.MTD.TLS)
+	}
+	if _, err := os.Stat(certPath); err == nil {
+		t.Fatalf("expected no proxy certificate before enrollment")
+	}
+
+	_, err = Enroll(config, entry)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	client, _ := os.ReadFile(config.MTD.TLS.CertPath)
+	proxy, _ := os.ReadFile(certPath)
+	config, _ = Rotate(config)
+	if second, _ := os.ReadFile(config.MTD.TLS.CertPath); string(client) != string(second) {
+		t.Fatalf("expected fresh client certificate to be kept")
+	}
+
+	// renew everything expiring within the next year, proxy certificates are left to RenewProxies
+	config.MTD.PKI.RenewBefore = 365 * 24
+	config, _ = Rotate(config)
+	if third, _ := os.ReadFile(config.MTD.TLS.CertPath); string(client) == string(third) {
+		t.Fatalf("expected expiring client certificate to be renewed")
+	}
+	if third, _ := os.ReadFile(certPath); string(proxy) != string(third) {
+		t.Fatalf("expected proxy certificate to only be renewed with its proxy")
+	}
+}
+
+func TestEnrollBundleWorksForMutualTLS(t *testing.T) {
+	config := testConfig(t)
+	config.MTD.SigningKey = "secret"
+	entry := netip.MustParseAddr("127.0.0.1")
+
+	config, err := Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	bundle, err := Enroll(config, entry)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if bundle.SigningKey != "secret" || bundle.EntryIP != entry {
+		t.Fatalf("unexpected bundle %+v", bundle)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(bundle.Cert), []byte(bundle.Key))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(bundle.CA))
+	s := pcsdktest.NewTLSServer(bundle.SigningKey, 0, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer s.Close()
+
+	client, err := pcsdk.ClientTLSConfig(config.MTD.TLS.CAPath, config.MTD.TLS.CertPath, config.MTD.TLS.KeyPath, "")
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	_, err = s.Proxy().WithTLS(client).Status(context.Background())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+}
+
+func TestRenewProxiesKeepsKey(t *testing.T) {
+	config := testConfig(t)
+	entry := netip.MustParseAddr("127.0.0.1")
+	config, err := Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	bundle, err := Enroll(config, entry)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	cert, err := tls.X509KeyPair([]byte(bundle.Cert), []byte(bundle.Key))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(bundle.CA))
+	s := pcsdktest.NewTLSServer("", 0, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer s.Close()
+	config.MTD.ManagementPort = s.Addr().Port()
+	config.MTD.Proxies = map[netip.Addr]state.Proxy{entry: {Pin: pcsdk.Fingerprint(leaf)}}
+	a, _ := LoadOrCreate(config.MTD.PKI.Dir)
+	certPath, _ := a.ProxyPaths(entry)
+
+	RenewProxies(context.Background(), config, pcsdk.NewFleet(config))
+	if s.Certificate() != nil {
+		t.Fatalf("expected fresh proxy certificate to be kept")
+	}
+
+	// a proxy that can not install certificates keeps the enrolled one
+	config.MTD.PKI.RenewBefore = 365 * 24
+	s.SetCapabilities(pcsdk.CapabilityBatch)
+	RenewProxies(context.Background(), config, pcsdk.NewFleet(config))
+	if current, _ := os.ReadFile(certPath); string(current) != bundle.Cert || s.Certificate() != nil {
+		t.Fatalf("expected proxy certificate to be kept without delivery")
+	}
+
+	s.SetCapabilities(pcsdk.CapabilityCertificate)
+	RenewProxies(context.Background(), config, pcsdk.NewFleet(config))
+	renewed, _ := os.ReadFile(certPath)
+	if string(renewed) == bundle.Cert || string(s.Certificate()) != string(renewed) {
+		t.Fatalf("expected renewed certificate to be installed on the proxy")
+	}
+	// issued for the key of the enrollment, so the pin still matches
+	cert, err = tls.X509KeyPair(renewed, []byte(bundle.Key))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if pcsdk.Fingerprint(leaf) != config.MTD.Proxies[entry].Pin {
+		t.Fatalf("expected renewed certificate to match the pin")
+	}
+}
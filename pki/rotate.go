@@ -0,0 +1,158 @@
+package pki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+// DefaultLifetime is how long issued certificates are valid when none is configured
+const DefaultLifetime = 7 * 24 * time.Hour
+
+// DefaultRenewBefore is how long before expiry certificates are renewed when none is configured
+const DefaultRenewBefore = 2 * 24 * time.Hour
+
+// Bundle is everything a new proxy needs to accept commands from Polemos
+type Bundle struct {
+	EntryIP        netip.Addr `yaml:"entry_ip"`
+	ManagementPort uint16     `yaml:"management_port"`
+	SigningKey     string     `yaml:"signing_key,omitempty"`
+	SignatureSkew  uint64     `yaml:"signature_skew,omitempty"`
+	CA             string     `yaml:"ca"`
+	Cert           string     `yaml:"cert"`
+	Key            string     `yaml:"key"`
+}
+
+// Rotate creates the CA if needed and renews the Polemos client certificate if it is about to expire, pointing the TLS
+// config at it. It does nothing if no pki dir is configured.
+// Proxy certificates are renewed by RenewProxies, as they have to be delivered to the proxies
+func Rotate(config state.Config) (state.Config, error) {
+	if config.MTD.PKI.Dir == "" {
+		return config, nil
+	}
+	a, err := LoadOrCreate(config.MTD.PKI.Dir)
+	if err != nil {
+		return config, err
+	}
+	lifetime, before := durations(config)
+
+	certPath, keyPath := a.ClientPaths()
+	renewed, err := a.Renew(certPath, keyPath, "polemos", nil, false, lifetime, before)
+	if err != nil {
+		return config, fmt.Errorf("could not renew client certificate: %w", err)
+	}
+	if renewed {
+		fmt.Println("Renewed client certificate:\t", certPath)
+	}
+	config.MTD.TLS.CAPath = a.CAPath()
+	config.MTD.TLS.CertPath = certPath
+	config.MTD.TLS.KeyPath = keyPath
+	return config, nil
+}
+
+// RenewProxies renews the certificate of every enrolled proxy that is about to expire and installs it on the proxy.
+// The certificate is issued for the key the proxy got at enrollment, so its pin stays valid. It is only kept once the
+// proxy installed it, a proxy that could not be reached is tried again on the next call
+func RenewProxies(ctx context.Context, config state.Config, fleet *pcsdk.ProxyFleet) {
+	if config.MTD.PKI.Dir == "" {
+		return
+	}
+	a, err := LoadOrCreate(config.MTD.PKI.Dir)
+	if err != nil {
+		fmt.Println("Error loading certificate authority:\t", err)
+		return
+	}
+	lifetime, before := durations(config)
+
+	for _, entry := range entries(config) {
+		certPath, keyPath := a.ProxyPaths(entry)
+		if _, err := os.Stat(certPath); err != nil {
+			// not enrolled through this CA
+			continue
+		}
+		if !NeedsRenewal(certPath, before) {
+			continue
+		}
+		certPEM, err := a.Reissue(keyPath, entry.String(), []netip.Addr{entry}, true, lifetime)
+		if err != nil {
+			fmt.Printf("Error renewing proxy certificate of %s:\t %s\n", entry, err)
+			continue
+		}
+		err = fleet.Target(ctx, entry, func(ctx context.Context, p pcsdk.Proxy) error {
+			return p.InstallCertificate(ctx, certPEM)
+		})
+		if errors.Is(err, pcsdk.ErrUnsupported) {
+			fmt.Printf("Proxy %s can not install certificates, enroll it again before %s expires\n", entry, certPath)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Error installing proxy certificate on %s:\t %s\n", entry, err)
+			continue
+		}
+		err = ioutil.WriteFile(certPath, certPEM, 0644)
+		if err != nil {
+			fmt.Printf("Error saving proxy certificate of %s:\t %s\n", entry, err)
+			continue
+		}
+		fmt.Println("Renewed proxy certificate:\t", certPath)
+	}
+}
+
+// Enroll returns the bundle for the proxy on entry, issuing its certificate if it has none yet
+func Enroll(config state.Config, entry netip.Addr) (Bundle, error) {
+	var b Bundle
+	if config.MTD.PKI.Dir == "" {
+		return b, fmt.Errorf("no pki dir configured")
+	}
+	a, err := LoadOrCreate(config.MTD.PKI.Dir)
+	if err != nil {
+		return b, err
+	}
+	lifetime, before := durations(config)
+	certPath, keyPath := a.ProxyPaths(entry)
+	_, err = a.Renew(certPath, keyPath, entry.String(), []netip.Addr{entry}, true, lifetime, before)
+	if err != nil {
+		return b, err
+	}
+	cert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return b, err
+	}
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return b, err
+	}
+	return Bundle{
+		EntryIP:        entry,
+		ManagementPort: config.ManagementAddr(entry).Port(),
+		SigningKey:     config.SigningKey(entry),
+		SignatureSkew:  config.MTD.SignatureSkew,
+		CA:             string(a.CAPEM()),
+		Cert:           string(cert),
+		Key:            string(key),
+	}, nil
+}
+
+func durations(config state.Config) (time.Duration, time.Duration) {
+	lifetime := DefaultLifetime
+	if config.MTD.PKI.Lifetime > 0 {
+		lifetime = time.Duration(config.MTD.PKI.Lifetime) * time.Hour
+	}
+	before := DefaultRenewBefore
+	if config.MTD.PKI.RenewBefore > 0 {
+		before = time.Duration(config.MTD.PKI.RenewBefore) * time.Hour
+	}
+	return lifetime, before
+}
+
+// entries returns every known proxy address
+func entries(config state.Config) []netip.Addr {
+	return config.ProxyAddrs()
+}
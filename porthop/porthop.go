@@ -0,0 +1,138 @@
+// Package porthop is an MTD strategy moving the entry port of services to a random new port on their proxy
+package porthop
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/state"
+)
+
+// Defaults used when the port_hop config leaves them empty
+const (
+	DefaultOverlap = 2 * time.Minute
+	DefaultMinPort = 20000
+	DefaultMaxPort = 40000
+)
+
+// Run hops every opted in service whose interval has passed and drops retired ports whose overlap window ended.
+// The proxies are updated by the reconciler, which keeps the retired ports forwarded during the overlap.
+// Nothing is hopped while the reconciler only reports, as no tunnel would ever forward the new port
+func Run(config state.Config) state.Config {
+	now := time.Now()
+	config = Prune(config, now)
+	if config.MTD.PortHop.Interval == 0 || config.MTD.ReconcileDryRun {
+		return config
+	}
+	interval := time.Duration(config.MTD.PortHop.Interval) * time.Minute
+
+	for id, service := range config.MTD.Services {
+		if !service.PortHop || !service.AdminEnabled || !service.Active {
+			continue
+		}
+		if now.Sub(service.HoppedAt) < interval {
+			continue
+		}
+		var err error
+		config, err = Hop(config, id, now)
+		if err != nil {
+			fmt.Println("Error hopping port:\t", err)
+			continue
+		}
+		fmt.Printf("Hopped service %s from port %d to %d\n", uuid.UUID(id).String(),
+			service.EntryPort, config.MTD.Services[id].EntryPort)
+	}
+	return config
+}
+
+// Hop moves a service to a random free entry port, keeping the old one forwarded until the overlap window ends.
+// The new port is forwarded by a new tunnel, as the incoming port of a tunnel can not be changed without closing it
+func Hop(config state.Config, id state.CustomUUID, now time.Time) (state.Config, error) {
+	service, ok := config.MTD.Services[id]
+	if !ok {
+		return config, errors.New("service not found")
+	}
+	port, err := freePort(config, service.Entries())
+	if err != nil {
+		return config, err
+	}
+
+	overlap := DefaultOverlap
+	if config.MTD.PortHop.Overlap > 0 {
+		overlap = time.Duration(config.MTD.PortHop.Overlap) * time.Second
+	}
+	if service.EntryPort != 0 {
+		// the tunnel forwarding the old port keeps doing so, the new port gets a tunnel of its own next to it
+		service.RetiredPorts = append(service.RetiredPorts, state.RetiredPort{Port: service.EntryPort, Until: now.Add(overlap),
+			TunnelID: service.Tunnel(id)})
+	}
+	service.TunnelID = state.CustomUUID(uuid.New())
+	service.EntryPort = port
+	service.HoppedAt = now
+	config.MTD.Services[id] = service
+	return config, nil
+}
+
+// Prune forgets retired ports whose overlap window has ended
+func Prune(config state.Config, now time.Time) state.Config {
+	for id, service := range config.MTD.Services {
+		if len(service.RetiredPorts) == 0 {
+			continue
+		}
+		var kept []state.RetiredPort
+		for _, retired := range service.RetiredPorts {
+			if now.Before(retired.Until) {
+				kept = append(kept, retired)
+			}
+		}
+		service.RetiredPorts = kept
+		config.MTD.Services[id] = service
+	}
+	return config
+}
+
+// freePort picks a random port in the configured range not used, or retired, by any service on any of the proxies
+func freePort(config state.Config, entries []netip.Addr) (uint16, error) {
+	min, max := uint16(DefaultMinPort), uint16(DefaultMaxPort)
+	if config.MTD.PortHop.MinPort != 0 {
+		min = config.MTD.PortHop.MinPort
+	}
+	if config.MTD.PortHop.MaxPort != 0 {
+		max = config.MTD.PortHop.MaxPort
+	}
+	if max < min {
+		return 0, errors.New("port_hop max_port is below min_port")
+	}
+
+	used := make(map[uint16]bool)
+	for _, entry := range entries {
+		for _, service := range config.MTD.Services {
+			if !service.HasEntry(entry) {
+				continue
+			}
+			used[service.EntryPort] = true
+			for _, retired := range service.RetiredPorts {
+				used[retired.Port] = true
+			}
+		}
+		used[config.ManagementAddr(entry).Port()] = true
+	}
+
+	size := int64(max-min) + 1
+	for attempt := 0; attempt < 100; attempt++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(size))
+		if err != nil {
+			return 0, err
+		}
+		port := min + uint16(n.Int64())
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, errors.New("no free port found in port_hop range")
+}
@@ -0,0 +1,120 @@
+package porthop
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/reconcile"
+	"github.com/thefeli73/polemos/state"
+)
+
+func testConfig(entry netip.Addr) (state.Config, state.CustomUUID) {
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	config.MTD.PortHop.Interval = 10
+	config.MTD.PortHop.Overlap = 60
+	config.MTD.PortHop.MinPort = 30000
+	config.MTD.PortHop.MaxPort = 30010
+	id := state.CustomUUID(uuid.New())
+	config.MTD.Services[id] = state.Service{AdminEnabled: true, Active: true, PortHop: true, EntryIP: entry,
+		EntryPort: 5555, ServiceIP: netip.MustParseAddr("10.0.0.1"), ServicePort: 80}
+	return config, id
+}
+
+func TestHop(t *testing.T) {
+	config, id := testConfig(netip.MustParseAddr("127.0.0.1"))
+	now := time.Now()
+
+	config, err := Hop(config, id, now)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	service := config.MTD.Services[id]
+	if service.EntryPort < 30000 || service.EntryPort > 30010 {
+		t.Fatalf("port %d outside range", service.EntryPort)
+	}
+	if len(service.RetiredPorts) != 1 || service.RetiredPorts[0].Port != 5555 || !service.RetiredPorts[0].Until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected retired ports %+v", service.RetiredPorts)
+	}
+
+	config = Prune(config, now.Add(2*time.Minute))
+	if len(config.MTD.Services[id].RetiredPorts) != 0 {
+		t.Fatalf("expected retired port to be pruned")
+	}
+}
+
+func TestHopAvoidsUsedPorts(t *testing.T) {
+	entry := netip.MustParseAddr("127.0.0.1")
+	config, id := testConfig(entry)
+	config.MTD.PortHop.MaxPort = 30001
+	config.MTD.Services[state.CustomUUID(uuid.New())] = state.Service{EntryIP: entry, EntryPort: 30000}
+
+	config, err := Hop(config, id, time.Now())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if config.MTD.Services[id].EntryPort != 30001 {
+		t.Fatalf("expected the only free port, got %d", config.MTD.Services[id].EntryPort)
+	}
+	_, err = Hop(config, id, time.Now())
+	if err == nil {
+		t.Fatalf("expected no free port")
+	}
+}
+
+func TestRunRespectsIntervalAndOptIn(t *testing.T) {
+	config, id := testConfig(netip.MustParseAddr("127.0.0.1"))
+	other := state.CustomUUID(uuid.New())
+	config.MTD.Services[other] = state.Service{AdminEnabled: true, Active: true, EntryPort: 6666}
+
+	config = Run(config)
+	hopped := config.MTD.Services[id].EntryPort
+	if hopped == 5555 || config.MTD.Services[other].EntryPort != 6666 {
+		t.Fatalf("unexpected ports %+v", config.MTD.Services)
+	}
+	config = Run(config)
+	if config.MTD.Services[id].EntryPort != hopped {
+		t.Fatalf("expected no hop before the interval passed")
+	}
+}
+
+func TestRunSkipsDryRun(t *testing.T) {
+	config, id := testConfig(netip.MustParseAddr("127.0.0.1"))
+	config.MTD.ReconcileDryRun = true
+
+	config = Run(config)
+	if service := config.MTD.Services[id]; service.EntryPort != 5555 || len(service.RetiredPorts) != 0 {
+		t.Fatalf("expected no hop while the reconciler only reports, got %+v", service)
+	}
+}
+
+func TestHopOverlapOnProxy(t *testing.T) {
+	s := pcsdktest.NewServer()
+	defer s.Close()
+	config, id := testConfig(s.Addr().Addr())
+	config.MTD.ManagementPort = s.Addr().Port()
+	reconcile.Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+
+	config, _ = Hop(config, id, time.Now())
+	report := reconcile.Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	// the live tunnel is left alone, only the one for the new port is created
+	if report.Failed != 0 || report.Missing != 1 || report.Drifted != 0 || report.Orphaned != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	tunnels := s.Tunnels()
+	service := config.MTD.Services[id]
+	if tunnels[service.Tunnel(id)].IncomingPort != service.EntryPort || tunnels[id].IncomingPort != 5555 {
+		t.Fatalf("expected old and new port to be forwarded, got %+v", tunnels)
+	}
+
+	config = Prune(config, time.Now().Add(time.Hour))
+	reconcile.Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	if len(s.Tunnels()) != 1 {
+		t.Fatalf("expected old port to be closed, got %+v", s.Tunnels())
+	}
+}
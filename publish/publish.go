@@ -0,0 +1,275 @@
+// Package publish serves the current entry of port hopping services to legitimate clients as signed json.
+// Clients are legitimate if they present a certificate of the client ca, documents are only served over https
+package publish
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/state"
+)
+
+// DefaultValidity is how long a published document is valid when none is configured
+const DefaultValidity = 5 * time.Minute
+
+// Entry is where clients currently reach a service
+type Entry struct {
+	Id        state.CustomUUID `json:"id"`
+	EntryIP   netip.Addr       `json:"entry_ip"`
+	EntryPort uint16           `json:"entry_port"`
+	// Alternates are redundant proxies in rotation, reachable on the same port
+	Alternates []netip.Addr `json:"alternates,omitempty"`
+}
+
+// Document is the signed list of entries served to clients
+type Document struct {
+	Services  []Entry `json:"services"`
+	Issued    int64   `json:"issued"`
+	Expires   int64   `json:"expires"`
+	Signature string  `json:"signature,omitempty"`
+}
+
+// Server serves the entries of the last config it was updated with
+type Server struct {
+	mu       sync.Mutex
+	key      ed25519.PrivateKey
+	validity time.Duration
+	entries  []Entry
+}
+
+// NewServer returns a server signing its documents with key, valid for validity
+func NewServer(key ed25519.PrivateKey, validity time.Duration) *Server {
+	if validity <= 0 {
+		validity = DefaultValidity
+	}
+	return &Server{key: key, validity: validity}
+}
+
+// Start serves the entries of config on the configured address, it returns nil if publishing is disabled
+func Start(config state.Config) (*Server, error) {
+	if config.MTD.Publish.Listen == "" {
+		return nil, nil
+	}
+	tlsConfig, err := TLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadOrCreateKey(config.MTD.Publish.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	s := NewServer(key, time.Duration(config.MTD.Publish.Validity)*time.Second)
+	s.Update(config)
+	server := &http.Server{Addr: config.MTD.Publish.Listen, Handler: s, TLSConfig: tlsConfig}
+	go func() {
+		err := server.ListenAndServeTLS("", "")
+		fmt.Println("Error publishing entries:\t", err)
+	}()
+	fmt.Printf("Publishing entries on %s (public key %s)\n", config.MTD.Publish.Listen, base64.StdEncoding.EncodeToString(s.PublicKey()))
+	return s, nil
+}
+
+// TLSConfig loads the certificate entries are served with, requiring clients to present a certificate of the client ca.
+// Anyone reading the entries could follow every hop, so they are never published without
+func TLSConfig(config state.Config) (*tls.Config, error) {
+	if config.MTD.Publish.CertPath == "" {
+		return nil, errors.New("publish requires a cert_path, entries are only served over https")
+	}
+	caPath := config.MTD.Publish.ClientCAPath
+	if caPath == "" {
+		caPath = config.MTD.TLS.CAPath
+	}
+	if caPath == "" {
+		return nil, errors.New("publish requires a client_ca_path or tls ca to authenticate clients")
+	}
+	cert, err := tls.LoadX509KeyPair(config.MTD.Publish.CertPath, config.MTD.Publish.CertKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load publish certificate: %w", err)
+	}
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates found in client ca")
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool,
+		ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Update replaces the published entries with the port hopping services in config
+func (s *Server) Update(config state.Config) {
+	if s == nil {
+		return
+	}
+	var entries []Entry
+	for id, service := range config.MTD.Services {
+		if !service.PortHop || !service.AdminEnabled || !service.Active {
+			continue
+		}
+		var alternates []netip.Addr
+		for _, entry := range service.Rotation() {
+			if entry != service.EntryIP {
+				alternates = append(alternates, entry)
+			}
+		}
+		entries = append(entries, Entry{id, service.EntryIP, service.EntryPort, alternates})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return uuid.UUID(entries[i].Id).String() < uuid.UUID(entries[j].Id).String()
+	})
+	s.mu.Lock()
+	s.entries = entries
+	s.mu.Unlock()
+}
+
+// PublicKey returns the key clients verify documents with
+func (s *Server) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// ServeHTTP serves /ports with all entries, /ports/<uuid> with one and /key with the public key, only to clients
+// with a verified certificate
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	entries := s.entries
+	s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/key":
+		w.Write([]byte(base64.StdEncoding.EncodeToString(s.PublicKey())))
+		return
+	case r.URL.Path == "/ports":
+	case strings.HasPrefix(r.URL.Path, "/ports/"):
+		id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/ports/"))
+		if err != nil {
+			http.Error(w, "invalid service id", http.StatusBadRequest)
+			return
+		}
+		var found []Entry
+		for _, e := range entries {
+			if e.Id == state.CustomUUID(id) {
+				found = append(found, e)
+			}
+		}
+		if len(found) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		entries = found
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := s.Sign(entries, time.Now())
+	if err != nil {
+		http.Error(w, "could not sign entries", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// Sign returns the serialized document for entries, issued at now
+func (s *Server) Sign(entries []Entry, now time.Time) ([]byte, error) {
+	if entries == nil {
+		entries = []Entry{}
+	}
+	d := Document{Services: entries, Issued: now.Unix(), Expires: now.Add(s.validity).Unix()}
+	unsigned, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	d.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, unsigned))
+	return json.Marshal(d)
+}
+
+// Verify checks the signature and expiry of a serialized document, as a client would
+func Verify(data []byte, key ed25519.PublicKey, now time.Time) (Document, error) {
+	var d Document
+	err := json.Unmarshal(data, &d)
+	if err != nil {
+		return d, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(d.Signature)
+	if err != nil {
+		return d, fmt.Errorf("could not decode signature: %w", err)
+	}
+	unsigned := d
+	unsigned.Signature = ""
+	message, err := json.Marshal(unsigned)
+	if err != nil {
+		return d, err
+	}
+	if !ed25519.Verify(key, message, signature) {
+		return d, errors.New("invalid signature")
+	}
+	if now.Unix() > d.Expires {
+		return d, errors.New("document expired")
+	}
+	return d, nil
+}
+
+// LoadOrCreateKey loads the signing key from a pem file, generating it if there is none
+func LoadOrCreateKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no key in %s", filename)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ed, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 key", filename)
+		}
+		return ed, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
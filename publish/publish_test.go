@@ -0,0 +1,164 @@
+package publish
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pki"
+	"github.com/thefeli73/polemos/state"
+)
+
+func testServer(t *testing.T) (*Server, state.CustomUUID) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	s := NewServer(key, time.Minute)
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	id := state.CustomUUID(uuid.New())
+	config.MTD.Services[id] = state.Service{AdminEnabled: true, Active: true, PortHop: true,
+		EntryIP: netip.MustParseAddr("192.0.2.1"), EntryPort: 30000}
+	config.MTD.Services[state.CustomUUID(uuid.New())] = state.Service{AdminEnabled: true, Active: true, EntryPort: 5555}
+	s.Update(config)
+	return s, id
+}
+
+// request returns a request as if sent by a client with a verified certificate
+func request(target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest("GET", target, body)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	return r
+}
+
+func TestPortsSignedAndVerified(t *testing.T) {
+	s, id := testServer(t)
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, request("/ports/"+uuid.UUID(id).String(), nil))
+	data, _ := io.ReadAll(res.Body)
+
+	d, err := Verify(data, s.PublicKey(), time.Now())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if len(d.Services) != 1 || d.Services[0].Id != id || d.Services[0].EntryPort != 30000 {
+		t.Fatalf("unexpected document %+v", d)
+	}
+
+	_, err = Verify(data, s.PublicKey(), time.Now().Add(time.Hour))
+	if err == nil {
+		t.Fatalf("expected expired document to be rejected")
+	}
+	tampered := strings.Replace(string(data), "30000", "30001", 1)
+	_, err = Verify([]byte(tampered), s.PublicKey(), time.Now())
+	if err == nil {
+		t.Fatalf("expected tampered document to be rejected")
+	}
+}
+
+func TestPortsOnlyHoppingServices(t *testing.T) {
+	s, _ := testServer(t)
+	res := httptest.NewRecorder()
+	s.ServeHTTP(res, request("/ports", nil))
+	data, _ := io.ReadAll(res.Body)
+
+	d, err := Verify(data, s.PublicKey(), time.Now())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if len(d.Services) != 1 {
+		t.Fatalf("expected only the port hopping service, got %+v", d.Services)
+	}
+
+	res = httptest.NewRecorder()
+	s.ServeHTTP(res, request("/ports/"+uuid.NewString(), nil))
+	if res.Code != 404 {
+		t.Fatalf("expected unknown service to be not found, got %d", res.Code)
+	}
+}
+
+func TestPortsRequireClientCertificate(t *testing.T) {
+	s, _ := testServer(t)
+	var config state.Config
+	config.MTD.PKI.Dir = t.TempDir()
+	_, err := TLSConfig(config)
+	if err == nil {
+		t.Fatalf("expected publishing without certificate to fail")
+	}
+	config, err = pki.Rotate(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	bundle, err := pki.Enroll(config, netip.MustParseAddr("127.0.0.1"))
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	config.MTD.Publish.CertPath = filepath.Join(t.TempDir(), "publish.crt")
+	config.MTD.Publish.CertKeyPath = filepath.Join(t.TempDir(), "publish.pem")
+	ioutil.WriteFile(config.MTD.Publish.CertPath, []byte(bundle.Cert), 0600)
+	ioutil.WriteFile(config.MTD.Publish.CertKeyPath, []byte(bundle.Key), 0600)
+
+	hs := httptest.NewUnstartedServer(s)
+	hs.TLS, err = TLSConfig(config)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	hs.StartTLS()
+	defer hs.Close()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(bundle.CA))
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = anonymous.Get(hs.URL + "/ports")
+	if err == nil {
+		t.Fatalf("expected client without certificate to be rejected")
+	}
+
+	cert, err := tls.LoadX509KeyPair(config.MTD.TLS.CertPath, config.MTD.TLS.KeyPath)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool,
+		Certificates: []tls.Certificate{cert}}}}
+	res, err := client.Get(hs.URL + "/ports")
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	data, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	_, err = Verify(data, s.PublicKey(), time.Now())
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	// the handler itself never answers without a verified certificate either
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/ports", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("\nExpected:\t %d\nGot:\t\t %d\n", http.StatusUnauthorized, rec.Code)
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "publish.key")
+	a, err := LoadOrCreateKey(filename)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	b, err := LoadOrCreateKey(filename)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if !a.Equal(b) {
+		t.Fatalf("expected existing key to be loaded")
+	}
+}
@@ -0,0 +1,279 @@
+// Package reconcile converges the tunnels on every proxy to the services in the config
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/state"
+)
+
+// Kinds of drift between the config and a proxy
+const (
+	Missing  = "missing"
+	Drifted  = "drifted"
+	Orphaned = "orphaned"
+)
+
+// Action is a single difference between the desired and the actual tunnel table of a proxy
+type Action struct {
+	Kind  string
+	Proxy netip.Addr
+	Id    state.CustomUUID
+	Want  pcsdk.Tunnel
+	Have  pcsdk.Tunnel
+	Err   error
+}
+
+func (a Action) String() string {
+	id := uuid.UUID(a.Id).String()
+	switch a.Kind {
+	case Missing:
+		return fmt.Sprintf("%s\t+ %s\t:%d/%s -> %s:%d", a.Proxy, id, a.Want.IncomingPort, a.Want.Network(), a.Want.DestinationIP, a.Want.DestinationPort)
+	case Orphaned:
+		return fmt.Sprintf("%s\t- %s\t:%d/%s -> %s:%d", a.Proxy, id, a.Have.IncomingPort, a.Have.Network(), a.Have.DestinationIP, a.Have.DestinationPort)
+	default:
+		return fmt.Sprintf("%s\t~ %s\t:%d/%s -> %s:%d (was :%d/%s -> %s:%d)", a.Proxy, id,
+			a.Want.IncomingPort, a.Want.Network(), a.Want.DestinationIP, a.Want.DestinationPort,
+			a.Have.IncomingPort, a.Have.Network(), a.Have.DestinationIP, a.Have.DestinationPort)
+	}
+}
+
+// Report sums up a reconciliation run
+type Report struct {
+	Proxies     int
+	Unreachable int
+	Missing     int
+	Drifted     int
+	Orphaned    int
+	Applied     int
+	Failed      int
+	Limited     int
+	Actions     []Action
+	Restarted   []netip.Addr
+}
+
+// Drift returns the number of tunnels that differed from the config
+func (r Report) Drift() int {
+	return r.Missing + r.Drifted + r.Orphaned
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%d proxies (%d unreachable), %d drifted tunnels (%d missing, %d drifted, %d orphaned), %d fixed, %d failed, %d at connection limit",
+		r.Proxies, r.Unreachable, r.Drift(), r.Missing, r.Drifted, r.Orphaned, r.Applied, r.Failed, r.Limited)
+}
+
+// Desired returns the tunnels every known proxy should have according to the enabled and active services
+func Desired(config state.Config) map[netip.Addr]map[state.CustomUUID]pcsdk.Tunnel {
+	desired := make(map[netip.Addr]map[state.CustomUUID]pcsdk.Tunnel)
+	for _, entry := range config.ProxyAddrs() {
+		desired[entry] = make(map[state.CustomUUID]pcsdk.Tunnel)
+	}
+	for id, service := range config.MTD.Services {
+		if !service.AdminEnabled || !service.Active {
+			continue
+		}
+		// every entry proxy keeps identical tunnels, also those out of rotation so they are ready when back
+		for _, entry := range service.Entries() {
+			for tunnelID, t := range ServiceTunnels(id, service, time.Now()) {
+				desired[entry][tunnelID] = t
+			}
+		}
+	}
+	return desired
+}
+
+// ServiceTunnels returns the tunnels forwarding a service at now: the one of its entry port and those of the ports it
+// hopped away from until their overlap window ends, which keep the tunnel already forwarding them so open connections
+// are kept
+func ServiceTunnels(id state.CustomUUID, service state.Service, now time.Time) map[state.CustomUUID]pcsdk.Tunnel {
+	tunnels := map[state.CustomUUID]pcsdk.Tunnel{service.Tunnel(id): pcsdk.ServiceTunnel(service)}
+	for _, retired := range service.RetiredPorts {
+		if now.Before(retired.Until) {
+			t := pcsdk.ServiceTunnel(service)
+			t.IncomingPort = retired.Port
+			tunnels[RetiredTunnelID(id, retired)] = t
+		}
+	}
+	return tunnels
+}
+
+// RetiredTunnelID returns the id of the tunnel still forwarding a previous entry port of a service, derived from the
+// port for retired ports that do not record their tunnel
+func RetiredTunnelID(service state.CustomUUID, retired state.RetiredPort) state.CustomUUID {
+	if !retired.TunnelID.IsZero() {
+		return retired.TunnelID
+	}
+	return state.CustomUUID(uuid.NewSHA1(uuid.UUID(service), []byte(fmt.Sprintf("retired-port-%d", retired.Port))))
+}
+
+// Diff returns the actions turning the tunnel table have of proxy into want, deletions first so ports are freed
+func Diff(proxy netip.Addr, want map[state.CustomUUID]pcsdk.Tunnel, have map[state.CustomUUID]pcsdk.Tunnel) []Action {
+	var actions []Action
+	for id, h := range have {
+		if _, ok := want[id]; !ok {
+			actions = append(actions, Action{Kind: Orphaned, Proxy: proxy, Id: id, Have: h})
+		}
+	}
+	for id, w := range want {
+		h, ok := have[id]
+		if !ok {
+			actions = append(actions, Action{Kind: Missing, Proxy: proxy, Id: id, Want: w})
+		} else if !h.Matches(w) {
+			actions = append(actions, Action{Kind: Drifted, Proxy: proxy, Id: id, Want: w, Have: h})
+		}
+	}
+	order := map[string]int{Orphaned: 0, Drifted: 1, Missing: 2}
+	sort.Slice(actions, func(i, j int) bool {
+		if order[actions[i].Kind] != order[actions[j].Kind] {
+			return order[actions[i].Kind] < order[actions[j].Kind]
+		}
+		return uuid.UUID(actions[i].Id).String() < uuid.UUID(actions[j].Id).String()
+	})
+	return actions
+}
+
+// restarts tracks the restarts of every proxy seen by the reconciler, across Reconcile and Replay
+var restarts = pcsdk.NewRestartTracker()
+
+// Replaced forgets the restarts the reconciler saw from the proxy on addr, as it was replaced on purpose
+func Replaced(addr netip.AddrPort) {
+	restarts.Forget(addr)
+}
+
+// Reconcile compares the status of every proxy of the fleet with the config and, unless dryRun, converges each proxy
+// in one batch
+func Reconcile(ctx context.Context, config state.Config, fleet *pcsdk.ProxyFleet, dryRun bool) Report {
+	return run(ctx, config, fleet, dryRun, nil)
+}
+
+// Replay reconciles only the proxies on entries, e.g. those the fleet saw restarting, to give them back their tunnels
+func Replay(ctx context.Context, config state.Config, fleet *pcsdk.ProxyFleet, entries []netip.Addr, dryRun bool) Report {
+	only := make(map[netip.Addr]bool, len(entries))
+	for _, entry := range entries {
+		only[entry] = true
+	}
+	return run(ctx, config, fleet, dryRun, only)
+}
+
+func run(ctx context.Context, config state.Config, fleet *pcsdk.ProxyFleet, dryRun bool, only map[netip.Addr]bool) Report {
+	var report Report
+	for entry, want := range Desired(config) {
+		if only != nil && !only[entry] {
+			continue
+		}
+		report.Proxies++
+		member, ok := fleet.Get(entry)
+		if !ok {
+			fmt.Printf("error reaching proxy %s: not part of the fleet yet\n", entry)
+			report.Unreachable++
+			continue
+		}
+		proxy := member.Proxy
+		status, err := proxy.Status(ctx)
+		if err != nil {
+			fmt.Printf("error reaching proxy %s: %s\n", entry, err)
+			report.Unreachable++
+			continue
+		}
+		if restarts.Observe(proxy.Addr(), status) {
+			fmt.Printf("Proxy %s restarted (up %s), replaying %d tunnels\n", entry, status.UptimeDuration(), len(want))
+			report.Restarted = append(report.Restarted, entry)
+		}
+		for id, tunnel := range status.Tunnels {
+			if tunnel.AtLimit() {
+				fmt.Printf("Tunnel %s on %s at its limit: %s\n", uuid.UUID(id), entry, tunnel.Usage())
+				report.Limited++
+			}
+		}
+		actions := Diff(entry, want, status.Tunnels)
+		if !dryRun && len(actions) > 0 {
+			actions = converge(ctx, proxy, actions)
+		}
+		for _, a := range actions {
+			switch a.Kind {
+			case Missing:
+				report.Missing++
+			case Drifted:
+				report.Drifted++
+			case Orphaned:
+				report.Orphaned++
+			}
+			if dryRun {
+				continue
+			}
+			if a.Err != nil {
+				report.Failed++
+			} else {
+				report.Applied++
+			}
+		}
+		report.Actions = append(report.Actions, actions...)
+	}
+	return report
+}
+
+// converge applies the actions of one proxy as a batch and records the outcome of each
+func converge(ctx context.Context, proxy pcsdk.Proxy, actions []Action) []Action {
+	b := proxy.Batch()
+	var index []int
+	for i, a := range actions {
+		switch {
+		case a.Kind == Orphaned:
+			b.Delete(a.Id)
+		case a.Kind == Missing:
+			b.CreateTunnel(a.Id, a.Want)
+		case a.Want.IncomingPort != a.Have.IncomingPort || a.Want.Network() != a.Have.Network():
+			// the incoming port and protocol of a tunnel can not be modified
+			b.Delete(a.Id)
+			index = append(index, i)
+			b.CreateTunnel(a.Id, a.Want)
+		default:
+			b.ModifyTunnel(a.Id, a.Want)
+		}
+		index = append(index, i)
+	}
+	results, _ := b.Execute(ctx)
+	for i, r := range results {
+		if r.Err != nil && actions[index[i]].Err == nil {
+			actions[index[i]].Err = r.Err
+		}
+	}
+	return actions
+}
+
+// Run runs Reconcile and logs the drift found, and every action if dryRun
+func Run(config state.Config, fleet *pcsdk.ProxyFleet, dryRun bool) Report {
+	t := time.Now()
+	report := Reconcile(context.Background(), config, fleet, dryRun)
+	log(report, dryRun)
+	fmt.Printf("Reconciled %s (took %s)\n", report, time.Since(t).Round(100*time.Millisecond).String())
+	return report
+}
+
+// RunReplay runs Replay for the proxies on entries and logs the actions that failed, and every action if dryRun
+func RunReplay(config state.Config, fleet *pcsdk.ProxyFleet, entries []netip.Addr, dryRun bool) Report {
+	if len(entries) == 0 {
+		return Report{}
+	}
+	t := time.Now()
+	report := Replay(context.Background(), config, fleet, entries, dryRun)
+	log(report, dryRun)
+	fmt.Printf("Replayed %s (took %s)\n", report, time.Since(t).Round(100*time.Millisecond).String())
+	return report
+}
+
+func log(report Report, dryRun bool) {
+	for _, a := range report.Actions {
+		if dryRun {
+			fmt.Println("Drift:\t", a)
+		} else if a.Err != nil {
+			fmt.Printf("Error reconciling %s: %s\n", a, a.Err)
+		}
+	}
+}
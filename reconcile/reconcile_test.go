@@ -0,0 +1,182 @@
+package reconcile
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/state"
+)
+
+// fixture returns a fake proxy drifted from a config in every possible way
+func fixture(t *testing.T) (*pcsdktest.Server, state.Config) {
+	s := pcsdktest.NewServer()
+	t.Cleanup(s.Close)
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	config.MTD.ManagementPort = s.Addr().Port()
+	entry := s.Addr().Addr()
+
+	service := func(port uint16, ip string) state.CustomUUID {
+		id := state.CustomUUID(uuid.New())
+		config.MTD.Services[id] = state.Service{AdminEnabled: true, Active: true, EntryIP: entry, EntryPort: port,
+			ServiceIP: netip.MustParseAddr(ip), ServicePort: 80}
+		return id
+	}
+	service(5555, "10.0.0.1")
+	moved := service(5556, "10.0.0.2")
+	hopped := service(5557, "10.0.0.3")
+	inSync := service(5558, "10.0.0.4")
+	s.SetTunnel(moved, pcsdk.Tunnel{IncomingPort: 5556, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.99")})
+	s.SetTunnel(hopped, pcsdk.Tunnel{IncomingPort: 6000, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.3")})
+	s.SetTunnel(inSync, pcsdk.Tunnel{IncomingPort: 5558, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.4")})
+	s.SetTunnel(state.CustomUUID(uuid.New()), pcsdk.Tunnel{IncomingPort: 7000, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.5")})
+	return s, config
+}
+
+func TestReconcileConverges(t *testing.T) {
+	s, config := fixture(t)
+
+	report := Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	if report.Missing != 1 || report.Drifted != 2 || report.Orphaned != 1 || report.Applied != 4 || report.Failed != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	for entry, want := range Desired(config) {
+		have := s.Tunnels()
+		if len(Diff(entry, want, have)) != 0 {
+			t.Fatalf("proxy not converged: %+v", have)
+		}
+	}
+
+	report = Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	if report.Drift() != 0 {
+		t.Fatalf("expected no drift after converging, got %s", report)
+	}
+}
+
+func TestReconcileRecreatesOnProtocolChange(t *testing.T) {
+	s, config := fixture(t)
+	s.SetCapabilities(pcsdk.CapabilityBatch, pcsdk.CapabilityUDP)
+	var id state.CustomUUID
+	for u, service := range config.MTD.Services {
+		if service.EntryPort == 5558 {
+			id = u
+			service.Protocol = pcsdk.ProtocolUDP
+			config.MTD.Services[u] = service
+		}
+	}
+
+	report := Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	if report.Drifted != 3 || report.Failed != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	if s.Tunnels()[id].Network() != pcsdk.ProtocolUDP {
+		t.Fatalf("expected udp tunnel, got %+v", s.Tunnels()[id])
+	}
+}
+
+func TestReconcilePushesLimits(t *testing.T) {
+	s, config := fixture(t)
+	var id state.CustomUUID
+	for u, service := range config.MTD.Services {
+		if service.EntryPort == 5558 {
+			id = u
+			service.MaxConnections = 10
+			config.MTD.Services[u] = service
+		}
+	}
+
+	report := Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	if report.Drifted != 3 || report.Failed != 0 || s.Tunnels()[id].MaxConnections != 10 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	s.SetConnections(id, 10, 0)
+	report = Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	if report.Drift() != 0 || report.Limited != 1 {
+		t.Fatalf("unexpected report %s", report)
+	}
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	s, config := fixture(t)
+	before := s.Tunnels()
+
+	report := Reconcile(context.Background(), config, pcsdk.NewFleet(config), true)
+	if report.Drift() != 4 || report.Applied != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	if len(s.Tunnels()) != len(before) || s.Received() != 1 {
+		t.Fatalf("dry run changed the proxy")
+	}
+}
+
+func TestReconcileUnreachable(t *testing.T) {
+	s, config := fixture(t)
+	s.Close()
+
+	report := Reconcile(context.Background(), config, pcsdk.NewFleet(config), false)
+	if report.Unreachable != 1 || report.Drift() != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+}
+
+func TestDesiredSkipsInactive(t *testing.T) {
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	entry := netip.MustParseAddr("127.0.0.1")
+	config.MTD.Services[state.CustomUUID(uuid.New())] = state.Service{AdminEnabled: true, Active: false, EntryIP: entry}
+	config.MTD.Services[state.CustomUUID(uuid.New())] = state.Service{AdminEnabled: false, Active: true, EntryIP: entry}
+
+	desired := Desired(config)
+	if want, ok := desired[entry]; !ok || len(want) != 0 {
+		t.Fatalf("expected proxy without tunnels, got %+v", desired)
+	}
+}
+
+func TestDesiredRedundantEntries(t *testing.T) {
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	entry := netip.MustParseAddr("127.0.0.1")
+	redundant := netip.MustParseAddr("127.0.0.2")
+	id := state.CustomUUID(uuid.New())
+	config.MTD.Services[id] = state.Service{AdminEnabled: true, Active: true, EntryIP: entry, EntryPort: 5555,
+		ServiceIP: netip.MustParseAddr("10.0.0.1"), ServicePort: 80, EntryIPs: []netip.Addr{redundant},
+		OutOfRotation: []netip.Addr{redundant}}
+
+	desired := Desired(config)
+	if !desired[entry][id].Matches(desired[redundant][id]) || desired[redundant][id].IncomingPort != 5555 {
+		t.Fatalf("expected identical tunnels on every entry, got %+v", desired)
+	}
+}
+
+func TestReplayRestartedProxies(t *testing.T) {
+	s, config := fixture(t)
+	fleet := pcsdk.NewFleet(config)
+	fleet.Refresh(context.Background())
+	Reconcile(context.Background(), config, fleet, false)
+	converged := s.Tunnels()
+
+	fleet.Refresh(context.Background())
+	report := Replay(context.Background(), config, fleet, fleet.Restarted(), false)
+	if report.Proxies != 0 || report.Applied != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+
+	// the fleet checks every proxy before the reconciler runs, both have to learn about the restart
+	s.Restart()
+	fleet.Refresh(context.Background())
+	restarted := fleet.Restarted()
+	if len(restarted) != 1 || restarted[0] != s.Addr().Addr() {
+		t.Fatalf("expected fleet to detect restart, got %v", restarted)
+	}
+	report = Replay(context.Background(), config, fleet, restarted, false)
+	if len(report.Restarted) != 1 || report.Missing != len(converged) || report.Failed != 0 {
+		t.Fatalf("unexpected report %s", report)
+	}
+	if len(s.Tunnels()) != len(converged) {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", converged, s.Tunnels())
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"net/netip"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
@@ -19,10 +21,126 @@ type Config struct {
 type mtdconf struct {
     Services        map[CustomUUID]Service `yaml:"services"`
     ManagementPort  uint16      `yaml:"management_port"`
+    SigningKey      string      `yaml:"signing_key"`
+    SignatureSkew   uint64      `yaml:"signature_skew"`
+    NoncePath       string      `yaml:"nonce_path"`
+    CommandTimeout  uint64      `yaml:"command_timeout"`
+    CommandRetries  int         `yaml:"command_retries"`
+    Proxies         map[netip.Addr]Proxy `yaml:"proxies"`
+    TLS             tlsconf     `yaml:"tls"`
+    PKI             pkiconf     `yaml:"pki"`
+    ReconcileDryRun bool        `yaml:"reconcile_dry_run"`
+    RestartPoll     uint64      `yaml:"restart_poll"`
+    AlertWebhook    string      `yaml:"alert_webhook"`
+    DrainGrace      uint64      `yaml:"drain_grace"`
+    PortHop         porthopconf `yaml:"port_hop"`
+    Publish         publishconf `yaml:"publish"`
+    Canary          canaryconf  `yaml:"canary"`
+    Stats           statsconf   `yaml:"stats"`
+    FailoverAfter   int         `yaml:"failover_after"`
+    ProxyMove       proxymoveconf `yaml:"proxy_move"`
+    Bootstrap       bootstrapconf `yaml:"bootstrap"`
+    Hub             hubconf     `yaml:"hub"`
+}
+
+// Proxy is a Proxima Centauri instance Polemos manages, its settings override the global ones.
+// Proxies with a cloud id can be moved if their entry ip is the elastic ip of allocation id, which keeps the entry.
+// Proxies that pull get their commands through the hub instead of on their management port
+type Proxy struct {
+    SigningKey      string      `yaml:"signing_key"`
+    Pin             string      `yaml:"pin"`
+    ManagementPort  uint16      `yaml:"management_port,omitempty"`
+    CloudID         string      `yaml:"cloud_id,omitempty"`
+    AllocationID    string      `yaml:"allocation_id,omitempty"`
+    MovedAt         time.Time   `yaml:"moved_at,omitempty"`
+    Pull            bool        `yaml:"pull,omitempty"`
+}
+
+// tlsconf contains the certificates for mutual TLS with the proxies, plaintext is used if cert_path is empty
+type tlsconf struct {
+    CAPath          string      `yaml:"ca_path"`
+    CertPath        string      `yaml:"cert_path"`
+    KeyPath         string      `yaml:"key_path"`
+}
+
+// pkiconf configures the built-in certificate authority, it is disabled if dir is empty. Durations are in hours.
+// Proxy certificates are renewed for the key of their enrollment and installed on the proxy before they expire
+type pkiconf struct {
+    Dir             string      `yaml:"dir"`
+    Lifetime        uint64      `yaml:"lifetime"`
+    RenewBefore     uint64      `yaml:"renew_before"`
+}
+
+// porthopconf configures moving entry ports of services that opt in, it is disabled if interval is 0.
+// Interval is in minutes, overlap in seconds
+type porthopconf struct {
+    Interval        uint64      `yaml:"interval"`
+    Overlap         uint64      `yaml:"overlap"`
+    MinPort         uint16      `yaml:"min_port"`
+    MaxPort         uint16      `yaml:"max_port"`
+}
+
+// publishconf configures the endpoint publishing signed entry ports to clients, it is disabled if listen is empty.
+// It serves https with cert_path and only answers clients with a certificate of the client ca, the tls ca if empty.
+// Validity is in seconds
+type publishconf struct {
+    Listen          string      `yaml:"listen"`
+    KeyPath         string      `yaml:"key_path"`
+    Validity        uint64      `yaml:"validity"`
+    CertPath        string      `yaml:"cert_path"`
+    CertKeyPath     string      `yaml:"cert_key_path"`
+    ClientCAPath    string      `yaml:"client_ca_path"`
+}
+
+// canaryconf configures shifting new connections to a moved instance in steps (percent), it is disabled if steps is empty.
+// Step duration is in seconds, the move is rolled back if the new instance has more than max failures
+type canaryconf struct {
+    Steps           []uint32    `yaml:"steps"`
+    StepDuration    uint64      `yaml:"step_duration"`
+    MaxFailures     uint64      `yaml:"max_failures"`
+}
+
+// statsconf configures collecting the traffic of every service, it is disabled if path is empty.
+// History is the number of samples kept per service
+type statsconf struct {
+    Path            string      `yaml:"path"`
+    History         int         `yaml:"history"`
+}
+
+// proxymoveconf configures moving the proxies themselves to new instances, it is disabled if interval is 0.
+// Only proxies with an allocation id are moved. Interval is in minutes
+type proxymoveconf struct {
+    Interval        uint64      `yaml:"interval"`
+}
+
+// bootstrapconf configures installing Proxima Centauri on fresh proxy instances, it is disabled if images is empty.
+// Images are the base AMI to launch by region, install the shell commands installing the proxy, exec the command
+// running it and timeout the seconds to wait for it to answer. The keys of the proxy are passed in its user data, so
+// restrict access to the instance metadata service and to describing instance attributes when enabling it
+type bootstrapconf struct {
+    Images          map[string]string `yaml:"images"`
+    Install         string      `yaml:"install"`
+    Exec            string      `yaml:"exec"`
+    Timeout         uint64      `yaml:"timeout"`
+}
 
+// hubconf configures the hub proxies behind NAT register with to pull their commands, it is disabled if listen is empty.
+// Only proxies configured with pull are accepted, by their own signing key or a certificate of the tls ca for their entry ip.
+// It only serves https, so cert_path is required. Wait is in seconds
+type hubconf struct {
+    Listen          string      `yaml:"listen"`
+    CertPath        string      `yaml:"cert_path"`
+    KeyPath         string      `yaml:"key_path"`
+    RegistryPath    string      `yaml:"registry_path"`
+    Wait            uint64      `yaml:"wait"`
 }
 
-// Service contains all necessary information about a service to identify it in the cloud as well as configuring a proxy for it
+// Service contains all necessary information about a service to identify it in the cloud as well as configuring a proxy for it.
+// Protocol is tcp or udp, empty means tcp. Allowed sources restrict the clients of a service, empty allows everyone.
+// Max connections caps open connections and connection rate new connections per second, 0 means unlimited.
+// Proxy protocol is the PROXY protocol version (1 or 2) sent to the service, 0 sends none.
+// Entry ips are redundant proxies keeping the same tunnels as entry_ip, those failing status checks are out of rotation.
+// Tunnel id is the id of the tunnel forwarding entry_port on the proxies, empty means the id of the service
 type Service struct {
     CloudID         string      `yaml:"cloud_id"`
     AdminEnabled    bool        `yaml:"admin_enabled"`
@@ -31,6 +149,145 @@ type Service struct {
     EntryPort       uint16      `yaml:"entry_port"`
     ServiceIP       netip.Addr  `yaml:"service_ip"`
     ServicePort     uint16      `yaml:"service_port"`
+    PortHop         bool        `yaml:"port_hop"`
+    HoppedAt        time.Time   `yaml:"hopped_at,omitempty"`
+    TunnelID        CustomUUID  `yaml:"tunnel_id,omitempty"`
+    RetiredPorts    []RetiredPort `yaml:"retired_ports,omitempty"`
+    RetiredInstances []RetiredInstance `yaml:"retired_instances,omitempty"`
+    Backends        []Backend   `yaml:"backends,omitempty"`
+    Protocol        string      `yaml:"protocol,omitempty"`
+    AllowedSources  []netip.Prefix `yaml:"allowed_sources,omitempty"`
+    MaxConnections  uint32      `yaml:"max_connections,omitempty"`
+    ConnectionRate  uint32      `yaml:"connection_rate,omitempty"`
+    ProxyProtocol   uint8       `yaml:"proxy_protocol,omitempty"`
+    EntryIPs        []netip.Addr `yaml:"entry_ips,omitempty"`
+    OutOfRotation   []netip.Addr `yaml:"out_of_rotation,omitempty"`
+}
+
+// Entries returns every proxy of the service, entry_ip first followed by the redundant entry_ips
+func (s Service) Entries() []netip.Addr {
+    var entries []netip.Addr
+    seen := make(map[netip.Addr]bool)
+    for _, entry := range append([]netip.Addr{s.EntryIP}, s.EntryIPs...) {
+        if !entry.IsValid() || seen[entry] {
+            continue
+        }
+        seen[entry] = true
+        entries = append(entries, entry)
+    }
+    return entries
+}
+
+// Rotation returns the proxies of the service clients should currently use, i.e. those not out of rotation
+func (s Service) Rotation() []netip.Addr {
+    var rotation []netip.Addr
+    for _, entry := range s.Entries() {
+        if !s.InRotation(entry) {
+            continue
+        }
+        rotation = append(rotation, entry)
+    }
+    return rotation
+}
+
+// Tunnel returns the id of the tunnel forwarding the current entry port of the service with id
+func (s Service) Tunnel(id CustomUUID) CustomUUID {
+    if s.TunnelID.IsZero() {
+        return id
+    }
+    return s.TunnelID
+}
+
+// HasEntry returns if entry is one of the entry proxies of the service, in rotation or not
+func (s Service) HasEntry(entry netip.Addr) bool {
+    for _, e := range s.Entries() {
+        if e == entry {
+            return true
+        }
+    }
+    return false
+}
+
+// InRotation returns if entry is not out of rotation for the service
+func (s Service) InRotation(entry netip.Addr) bool {
+    for _, out := range s.OutOfRotation {
+        if out == entry {
+            return false
+        }
+    }
+    return true
+}
+
+// Backend is a weighted destination of a service, when a service has backends they replace service_ip and service_port
+type Backend struct {
+    IP              netip.Addr  `yaml:"ip"`
+    Port            uint16      `yaml:"port"`
+    Weight          uint32      `yaml:"weight"`
+}
+
+// RetiredPort is a previous entry port of a service, still forwarded until clients had time to learn the new one.
+// Tunnel id is the tunnel that forwarded the port before the hop, so its connections are kept
+type RetiredPort struct {
+    Port            uint16      `yaml:"port"`
+    Until           time.Time   `yaml:"until"`
+    TunnelID        CustomUUID  `yaml:"tunnel_id,omitempty"`
+}
+
+// RetiredInstance is a previous instance of a service and its image, cleaned up once every entry proxy of the service
+// forwards to the current instance
+type RetiredInstance struct {
+    CloudID         string      `yaml:"cloud_id"`
+    Image           string      `yaml:"image"`
+}
+
+// SigningKey returns the key used to sign commands for the proxy on entry, falling back to the global key
+func (c Config) SigningKey(entry netip.Addr) string {
+    if proxy, ok := c.MTD.Proxies[entry]; ok && proxy.SigningKey != "" {
+        return proxy.SigningKey
+    }
+    return c.MTD.SigningKey
+}
+
+// ManagementAddr returns the address commands for the proxy on entry are sent to
+func (c Config) ManagementAddr(entry netip.Addr) netip.AddrPort {
+    if proxy, ok := c.MTD.Proxies[entry]; ok && proxy.ManagementPort != 0 {
+        return netip.AddrPortFrom(entry, proxy.ManagementPort)
+    }
+    return netip.AddrPortFrom(entry, c.MTD.ManagementPort)
+}
+
+// ProxyAddrs returns every known proxy, from the proxies map and the entry ips of services, sorted
+func (c Config) ProxyAddrs() []netip.Addr {
+    seen := make(map[netip.Addr]bool)
+    var addrs []netip.Addr
+    for entry := range c.MTD.Proxies {
+        seen[entry] = true
+        addrs = append(addrs, entry)
+    }
+    for _, service := range c.MTD.Services {
+        for _, entry := range service.Entries() {
+            if seen[entry] {
+                continue
+            }
+            seen[entry] = true
+            addrs = append(addrs, entry)
+        }
+    }
+    sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+    return addrs
+}
+
+// IndexProxies adds the entry ip of every service missing from the proxies map, so every proxy has an entry
+func IndexProxies(config Config) Config {
+    if config.MTD.Proxies == nil {
+        config.MTD.Proxies = make(map[netip.Addr]Proxy)
+    }
+    for _, entry := range config.ProxyAddrs() {
+        if _, ok := config.MTD.Proxies[entry]; !ok {
+            config.MTD.Proxies[entry] = Proxy{}
+        }
+    }
+    return config
 }
 
 // CustomUUID is an alias for uuid.UUID to enable custom unmarshal function
@@ -51,11 +308,31 @@ func (u *CustomUUID) UnmarshalYAML(value *yaml.Node) error {
 	return nil
 }
 
+// IsZero returns if the uuid is unset, so it is left out of the yaml when empty
+func (u CustomUUID) IsZero() bool {
+	return u == CustomUUID{}
+}
+
 // MarshalYAML parses CustomUUID type to uuid string for yaml 
 func (u CustomUUID) MarshalYAML() (interface{}, error) {
 	return uuid.UUID(u).String(), nil
 }
 
+// UnmarshalText parses uuid text (e.g. json map keys) to CustomUUID type
+func (u *CustomUUID) UnmarshalText(text []byte) error {
+	id, err := uuid.ParseBytes(text)
+	if err != nil {
+		return err
+	}
+	*u = CustomUUID(id)
+	return nil
+}
+
+// MarshalText parses CustomUUID type to uuid text (e.g. json map keys)
+func (u CustomUUID) MarshalText() ([]byte, error) {
+	return []byte(uuid.UUID(u).String()), nil
+}
+
 // LoadConf loads config from a yaml file
 func LoadConf(filename string) (Config) {
     var config Config
@@ -81,16 +358,17 @@ func LoadConf(filename string) (Config) {
     return config
 }
 
-// SaveConf saves config to yaml file
+// SaveConf saves config to yaml file, only readable by its owner as it holds the signing keys
 func SaveConf(filename string, config Config) (error) {
     yamlBytes, err := yaml.Marshal(&config)
     if err != nil {
         return err
 	}
 
-	err = ioutil.WriteFile(filename, yamlBytes, 0644)
+	err = ioutil.WriteFile(filename, yamlBytes, 0600)
 	if err != nil {
         return err
 	}
-    return nil
+    // WriteFile keeps the mode of an existing file, e.g. one written before the keys were added
+    return os.Chmod(filename, 0600)
 }
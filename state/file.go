@@ -0,0 +1,23 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// WriteFileAtomic writes v as yaml to a temporary file and renames it over filename, so a crash never leaves it
+// half written
+func WriteFileAtomic(filename string, v interface{}, perm os.FileMode) error {
+	yamlBytes, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, yamlBytes, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
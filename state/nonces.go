@@ -0,0 +1,82 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Nonces keeps the last command nonce sent to each proxy, persisted so restarts keep counting upward
+type Nonces struct {
+	mu       sync.Mutex
+	filename string
+	last     map[string]uint64
+}
+
+var (
+	noncesMu   sync.Mutex
+	noncesOpen = make(map[string]*Nonces)
+)
+
+// OpenNonces returns the nonce store backed by filename, shared by every caller using the same file
+func OpenNonces(filename string) (*Nonces, error) {
+	noncesMu.Lock()
+	defer noncesMu.Unlock()
+
+	if n, ok := noncesOpen[filename]; ok {
+		return n, nil
+	}
+	n := &Nonces{filename: filename, last: make(map[string]uint64)}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = yaml.Unmarshal(data, &n.last)
+		if err != nil {
+			return nil, err
+		}
+		if n.last == nil {
+			n.last = make(map[string]uint64)
+		}
+	}
+	noncesOpen[filename] = n
+	return n, nil
+}
+
+// NewNonces returns a nonce store that is only kept in memory, e.g. for tests
+func NewNonces() *Nonces {
+	return &Nonces{last: make(map[string]uint64)}
+}
+
+// Next reserves and persists the next nonce for proxy, it is only returned once it is saved
+func (n *Nonces) Next(proxy string) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	next := n.last[proxy] + 1
+	n.last[proxy] = next
+	err := n.save()
+	if err != nil {
+		n.last[proxy] = next - 1
+		return 0, err
+	}
+	return next, nil
+}
+
+// Last returns the last nonce handed out for proxy
+func (n *Nonces) Last(proxy string) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.last[proxy]
+}
+
+// save writes the nonces
+func (n *Nonces) save() error {
+	if n.filename == "" {
+		return nil
+	}
+	return WriteFileAtomic(n.filename, n.last, 0600)
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNoncesPersist(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "nonces.yaml")
+	n, err := OpenNonces(filename)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		next, err := n.Next("127.0.0.1:14000")
+		if err != nil {
+			t.Fatalf(`%q`, err)
+		}
+		if next != i {
+			t.Fatalf("\nExpected:\t %d\nGot:\t\t %d\n", i, next)
+		}
+	}
+
+	// simulate a restart by dropping the shared store
+	noncesMu.Lock()
+	noncesOpen = make(map[string]*Nonces)
+	noncesMu.Unlock()
+
+	n, err = OpenNonces(filename)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	next, err := n.Next("127.0.0.1:14000")
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if next != 4 {
+		t.Fatalf("\nExpected:\t %d\nGot:\t\t %d\n", 4, next)
+	}
+	if n.Last("127.0.0.2:14000") != 0 {
+		t.Fatalf("expected unrelated proxy to start at 0")
+	}
+}
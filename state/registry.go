@@ -0,0 +1,107 @@
+package state
+
+import (
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Registration is a proxy that registered with Polemos to pull its commands instead of listening for them
+type Registration struct {
+	RegisteredAt time.Time `yaml:"registered_at"`
+	// LastSeen is when the proxy last registered or polled for commands
+	LastSeen   time.Time `yaml:"last_seen"`
+	RemoteAddr string    `yaml:"remote_addr"`
+}
+
+// Registry keeps the proxies that registered to pull their commands, persisted so restarts keep them
+type Registry struct {
+	mu       sync.Mutex
+	filename string
+	proxies  map[netip.Addr]Registration
+}
+
+// OpenRegistry returns the registry backed by filename
+func OpenRegistry(filename string) (*Registry, error) {
+	r := &Registry{filename: filename, proxies: make(map[netip.Addr]Registration)}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = yaml.Unmarshal(data, &r.proxies)
+		if err != nil {
+			return nil, err
+		}
+		if r.proxies == nil {
+			r.proxies = make(map[netip.Addr]Registration)
+		}
+	}
+	return r, nil
+}
+
+// NewRegistry returns a registry that is only kept in memory, e.g. for tests
+func NewRegistry() *Registry {
+	return &Registry{proxies: make(map[netip.Addr]Registration)}
+}
+
+// Register records that the proxy on entry registered from remote and persists it
+func (r *Registry) Register(entry netip.Addr, remote string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	reg, ok := r.proxies[entry]
+	if !ok {
+		reg.RegisteredAt = now
+	}
+	reg.LastSeen = now
+	reg.RemoteAddr = remote
+	r.proxies[entry] = reg
+	return r.save()
+}
+
+// Seen records that the proxy on entry polled for commands, it is only persisted with the next registration
+func (r *Registry) Seen(entry netip.Addr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.proxies[entry]
+	if !ok {
+		return false
+	}
+	reg.LastSeen = time.Now()
+	r.proxies[entry] = reg
+	return true
+}
+
+// Get returns the registration of the proxy on entry
+func (r *Registry) Get(entry netip.Addr) (Registration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.proxies[entry]
+	return reg, ok
+}
+
+// Entries returns the entry ip of every registered proxy, sorted
+func (r *Registry) Entries() []netip.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]netip.Addr, 0, len(r.proxies))
+	for entry := range r.proxies {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Less(entries[j]) })
+	return entries
+}
+
+// save writes the registrations
+func (r *Registry) save() error {
+	if r.filename == "" {
+		return nil
+	}
+	return WriteFileAtomic(r.filename, r.proxies, 0600)
+}
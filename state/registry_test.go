@@ -0,0 +1,37 @@
+package state
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryPersists(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registry.yaml")
+	entry := netip.MustParseAddr("192.0.2.1")
+	r, err := OpenRegistry(filename)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if r.Seen(entry) {
+		t.Fatalf("expected unregistered proxy not to be seen")
+	}
+	err = r.Register(entry, "198.51.100.1:40000")
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	first, _ := r.Get(entry)
+	err = r.Register(entry, "198.51.100.1:40001")
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	r, err = OpenRegistry(filename)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	reg, ok := r.Get(entry)
+	if !ok || reg.RemoteAddr != "198.51.100.1:40001" || !reg.RegisteredAt.Equal(first.RegisteredAt) {
+		t.Fatalf("unexpected registration %+v", reg)
+	}
+}
@@ -0,0 +1,229 @@
+// Package stats collects the traffic of every service from the proxies and keeps a rolling history of it
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/reconcile"
+	"github.com/thefeli73/polemos/state"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultHistory is the number of samples kept per service when none is configured
+const DefaultHistory = 1440
+
+// Sample is the traffic of a service at one point in time, counted since its proxies started. In and out are the bytes
+// received and sent since the previous sample
+type Sample struct {
+	Time              time.Time `yaml:"time"`
+	pcsdk.TunnelStats `yaml:",inline"`
+	In                uint64    `yaml:"in"`
+	Out               uint64    `yaml:"out"`
+}
+
+// Collector keeps the last samples of every service, persisted so restarts keep the history
+type Collector struct {
+	mu       sync.Mutex
+	filename string
+	size     int
+	history  map[state.CustomUUID][]Sample
+	// last are the counters of every tunnel on every proxy at the previous sample, so traffic is counted per source
+	last map[netip.Addr]map[state.CustomUUID]pcsdk.TunnelStats
+}
+
+// Open returns a collector backed by filename keeping size samples per service
+func Open(filename string, size int) (*Collector, error) {
+	if size <= 0 {
+		size = DefaultHistory
+	}
+	c := &Collector{filename: filename, size: size, history: make(map[state.CustomUUID][]Sample),
+		last: make(map[netip.Addr]map[state.CustomUUID]pcsdk.TunnelStats)}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = yaml.Unmarshal(data, &c.history)
+		if err != nil {
+			return nil, err
+		}
+		if c.history == nil {
+			c.history = make(map[state.CustomUUID][]Sample)
+		}
+	}
+	return c, nil
+}
+
+// Start opens the configured collector, it returns nil if collecting is disabled
+func Start(config state.Config) (*Collector, error) {
+	if config.MTD.Stats.Path == "" {
+		return nil, nil
+	}
+	return Open(config.MTD.Stats.Path, config.MTD.Stats.History)
+}
+
+// Run collects a sample of every service, logs their traffic since the previous sample and saves the history
+func (c *Collector) Run(config state.Config, fleet *pcsdk.ProxyFleet) {
+	if c == nil {
+		return
+	}
+	t := time.Now()
+	ids, err := c.Collect(context.Background(), config, fleet)
+	if err != nil {
+		fmt.Println("Error collecting stats:\t", err)
+	}
+	for _, id := range ids {
+		latest, _ := c.Latest(id)
+		in, out := c.Throughput(id)
+		fmt.Printf("Traffic %s:\t%d bytes in, %d bytes out, %d active connections (%d total)\n",
+			uuid.UUID(id), in, out, latest.ActiveConnections, latest.TotalConnections)
+	}
+	err = c.Save()
+	if err != nil {
+		fmt.Println("Error saving stats:\t", err)
+	}
+	fmt.Printf("Collected stats of %d services (took %s)\n", len(ids), time.Since(t).Round(100*time.Millisecond).String())
+}
+
+// Collect asks every proxy of the fleet for its stats and records a sample for each enabled and active service it forwards.
+// Tunnels kept for retired ports count towards their service. The traffic since the previous sample is counted per
+// tunnel on every proxy before summing it, so tunnels appearing or disappearing do not show up as traffic.
+// It returns the services sampled
+func (c *Collector) Collect(ctx context.Context, config state.Config, fleet *pcsdk.ProxyFleet) ([]state.CustomUUID, error) {
+	samples := make(map[state.CustomUUID]*Sample)
+	var errs []error
+	now := time.Now()
+	desired := reconcile.Desired(config)
+	c.mu.Lock()
+	for entry := range c.last {
+		if _, ok := desired[entry]; !ok {
+			// the proxy is gone, it is counted from scratch if it ever comes back
+			delete(c.last, entry)
+		}
+	}
+	c.mu.Unlock()
+	for entry := range desired {
+		member, ok := fleet.Get(entry)
+		if !ok {
+			continue
+		}
+		stats, err := member.Proxy.Stats(ctx)
+		if errors.Is(err, pcsdk.ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("proxy %s: %w", entry, err))
+			continue
+		}
+		for id, service := range config.MTD.Services {
+			if !service.AdminEnabled || !service.Active || !service.HasEntry(entry) {
+				continue
+			}
+			// redundant entry proxies of a service all count towards it
+			if samples[id] == nil {
+				samples[id] = &Sample{Time: now}
+			}
+			c.add(samples[id], entry, service.Tunnel(id), stats.Tunnels)
+			for _, retired := range service.RetiredPorts {
+				c.add(samples[id], entry, reconcile.RetiredTunnelID(id, retired), stats.Tunnels)
+			}
+		}
+		// proxies that did not answer keep their previous counters, so their traffic counts towards the next sample
+		c.mu.Lock()
+		c.last[entry] = stats.Tunnels
+		c.mu.Unlock()
+	}
+	var ids []state.CustomUUID
+	for id, sample := range samples {
+		c.record(id, *sample)
+		ids = append(ids, id)
+	}
+	return ids, errors.Join(errs...)
+}
+
+// add sums the counters of a tunnel on the proxy on entry into a sample, and its traffic since the previous sample.
+// A tunnel not seen on the proxy before has no traffic yet, as its counters may predate the collector
+func (c *Collector) add(sample *Sample, entry netip.Addr, id state.CustomUUID, tunnels map[state.CustomUUID]pcsdk.TunnelStats) {
+	s, ok := tunnels[id]
+	if !ok {
+		return
+	}
+	sample.BytesIn += s.BytesIn
+	sample.BytesOut += s.BytesOut
+	sample.ActiveConnections += s.ActiveConnections
+	sample.TotalConnections += s.TotalConnections
+
+	c.mu.Lock()
+	prev, ok := c.last[entry][id]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	sample.In += delta(prev.BytesIn, s.BytesIn)
+	sample.Out += delta(prev.BytesOut, s.BytesOut)
+}
+
+// record appends a sample to the history of a service, dropping the oldest ones beyond the history size
+func (c *Collector) record(id state.CustomUUID, sample Sample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	history := append(c.history[id], sample)
+	if len(history) > c.size {
+		history = append([]Sample(nil), history[len(history)-c.size:]...)
+	}
+	c.history[id] = history
+}
+
+// History returns a copy of the samples of a service, oldest first
+func (c *Collector) History(id state.CustomUUID) []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Sample(nil), c.history[id]...)
+}
+
+// Latest returns the last sample of a service
+func (c *Collector) Latest(id state.CustomUUID) (Sample, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	history := c.history[id]
+	if len(history) == 0 {
+		return Sample{}, false
+	}
+	return history[len(history)-1], true
+}
+
+// Throughput returns the bytes a service received and sent between its last two samples.
+// Counters of a tunnel that went down, e.g. because its proxy restarted, are counted from zero
+func (c *Collector) Throughput(id state.CustomUUID) (uint64, uint64) {
+	latest, ok := c.Latest(id)
+	if !ok {
+		return 0, 0
+	}
+	return latest.In, latest.Out
+}
+
+func delta(prev uint64, last uint64) uint64 {
+	if last < prev {
+		return last
+	}
+	return last - prev
+}
+
+// Save writes the history
+func (c *Collector) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.filename == "" {
+		return nil
+	}
+	return state.WriteFileAtomic(c.filename, c.history, 0600)
+}
@@ -0,0 +1,136 @@
+package stats
+
+import (
+	"context"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thefeli73/polemos/pcsdk"
+	"github.com/thefeli73/polemos/pcsdktest"
+	"github.com/thefeli73/polemos/reconcile"
+	"github.com/thefeli73/polemos/state"
+)
+
+func fixture(t *testing.T) (*pcsdktest.Server, state.Config, state.CustomUUID) {
+	s := pcsdktest.NewServer()
+	t.Cleanup(s.Close)
+	var config state.Config
+	config.MTD.Services = make(map[state.CustomUUID]state.Service)
+	config.MTD.ManagementPort = s.Addr().Port()
+	id := state.CustomUUID(uuid.New())
+	config.MTD.Services[id] = state.Service{AdminEnabled: true, Active: true, EntryIP: s.Addr().Addr(), EntryPort: 5555,
+		ServiceIP: netip.MustParseAddr("10.0.0.1"), ServicePort: 80,
+		RetiredPorts: []state.RetiredPort{{Port: 5554, Until: time.Now().Add(time.Minute)}}}
+	s.SetTunnel(id, pcsdk.Tunnel{IncomingPort: 5555, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	retired := reconcile.RetiredTunnelID(id, state.RetiredPort{Port: 5554})
+	s.SetTunnel(retired, pcsdk.Tunnel{IncomingPort: 5554, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	s.SetStats(id, pcsdk.TunnelStats{BytesIn: 100, BytesOut: 1000, ActiveConnections: 2, TotalConnections: 10})
+	s.SetStats(retired, pcsdk.TunnelStats{BytesIn: 10, BytesOut: 100, ActiveConnections: 1, TotalConnections: 5})
+	return s, config, id
+}
+
+func TestCollectSumsRetiredPorts(t *testing.T) {
+	_, config, id := fixture(t)
+	c, err := Open("", 10)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	ids, err := c.Collect(context.Background(), config, pcsdk.NewFleet(config))
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("expected one service, got %v %v", ids, err)
+	}
+	latest, _ := c.Latest(id)
+	expected := pcsdk.TunnelStats{BytesIn: 110, BytesOut: 1100, ActiveConnections: 3, TotalConnections: 15}
+	if latest.TunnelStats != expected {
+		t.Fatalf("\nExpected:\t %+v\nGot:\t\t %+v\n", expected, latest.TunnelStats)
+	}
+}
+
+func TestHistoryIsRollingAndPersisted(t *testing.T) {
+	s, config, id := fixture(t)
+	filename := filepath.Join(t.TempDir(), "stats.yaml")
+	c, err := Open(filename, 2)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	for _, in := range []uint64{200, 300, 50} {
+		s.SetStats(id, pcsdk.TunnelStats{BytesIn: in})
+		_, err = c.Collect(context.Background(), config, pcsdk.NewFleet(config))
+		if err != nil {
+			t.Fatalf(`%q`, err)
+		}
+	}
+	err = c.Save()
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+
+	c, err = Open(filename, 2)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	history := c.History(id)
+	if len(history) != 2 || history[0].BytesIn != 310 || history[1].BytesIn != 60 {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	// the tunnel restarted counting between the samples, the one of the retired port carried nothing
+	if in, _ := c.Throughput(id); in != 50 {
+		t.Fatalf("expected 50 bytes in, got %d", in)
+	}
+}
+
+func TestThroughputPerSource(t *testing.T) {
+	s, config, id := fixture(t)
+	c, _ := Open("", 10)
+	fleet := pcsdk.NewFleet(config)
+	_, err := c.Collect(context.Background(), config, fleet)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if in, out := c.Throughput(id); in != 0 || out != 0 {
+		t.Fatalf("expected no traffic on the first sample, got %d %d", in, out)
+	}
+
+	// the overlap of the retired port ended, its counters must not look like a restart of the service
+	s.SetStats(id, pcsdk.TunnelStats{BytesIn: 105, BytesOut: 1000})
+	service := config.MTD.Services[id]
+	service.RetiredPorts = nil
+	config.MTD.Services[id] = service
+	_, err = c.Collect(context.Background(), config, fleet)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if in, out := c.Throughput(id); in != 5 || out != 0 {
+		t.Fatalf("expected 5 bytes in, got %d %d", in, out)
+	}
+
+	// a tunnel appearing with counters from before, e.g. of another hop, is not new traffic either
+	retired := reconcile.RetiredTunnelID(id, state.RetiredPort{Port: 5553})
+	s.SetTunnel(retired, pcsdk.Tunnel{IncomingPort: 5553, DestinationPort: 80, DestinationIP: netip.MustParseAddr("10.0.0.1")})
+	s.SetStats(retired, pcsdk.TunnelStats{BytesIn: 5000, BytesOut: 5000})
+	s.SetStats(id, pcsdk.TunnelStats{BytesIn: 110, BytesOut: 1000})
+	service.RetiredPorts = []state.RetiredPort{{Port: 5553, Until: time.Now().Add(time.Minute)}}
+	config.MTD.Services[id] = service
+	_, err = c.Collect(context.Background(), config, fleet)
+	if err != nil {
+		t.Fatalf(`%q`, err)
+	}
+	if in, out := c.Throughput(id); in != 5 || out != 0 {
+		t.Fatalf("expected 5 bytes in, got %d %d", in, out)
+	}
+}
+
+func TestCollectSkipsUnsupported(t *testing.T) {
+	s, config, _ := fixture(t)
+	s.SetCapabilities(pcsdk.CapabilityBatch)
+	c, _ := Open("", 10)
+
+	ids, err := c.Collect(context.Background(), config, pcsdk.NewFleet(config))
+	if err != nil || len(ids) != 0 {
+		t.Fatalf("expected no samples, got %v %v", ids, err)
+	}
+}